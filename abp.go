@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// abpList is a compiled Adblock Plus filter list, the format GFWList uses.
+// A destination matches when a blocking filter matches it and no exception
+// (@@) filter does. Routing only sees host and port, so filters are matched
+// against a synthesized URL such as "https://host/".
+type abpList struct {
+	block    abpFilters
+	allow    abpFilters
+	Warnings []string
+}
+
+// abpFilters holds the filters of one kind. Plain "||domain" filters go into
+// a domain set that also matches subdomains; all others are regular expressions.
+type abpFilters struct {
+	domains  map[string]bool
+	patterns []abpPattern
+}
+
+type abpPattern struct {
+	source  string // case-insensitive regex source, also valid JavaScript
+	literal string // lowercase substring every match contains, for prefiltering
+	re      *regexp.Regexp
+}
+
+// abpDomainRegex matches the body of filters that can use the domain set.
+var abpDomainRegex = regexp.MustCompile(`^[a-z0-9-]+(\.[a-z0-9-]+)*$`)
+
+// parseABP compiles an ABP filter list. Element hiding rules are ignored;
+// filters that cannot be compiled, or that cannot be decided from the host
+// alone, are skipped with a warning.
+func parseABP(content string) *abpList {
+	l := &abpList{
+		block: abpFilters{domains: make(map[string]bool)},
+		allow: abpFilters{domains: make(map[string]bool)},
+	}
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "!") || strings.HasPrefix(line, "[") ||
+			strings.Contains(line, "##") || strings.Contains(line, "#@#") {
+			continue
+		}
+		if err := l.add(line); err != nil {
+			l.Warnings = append(l.Warnings, fmt.Sprintf("line %d: %s: %v", n, line, err))
+		}
+	}
+	return l
+}
+
+// add compiles a single filter into the list.
+func (l *abpList) add(filter string) error {
+	target := &l.block
+	if strings.HasPrefix(filter, "@@") {
+		target = &l.allow
+		filter = filter[2:]
+	}
+
+	if len(filter) > 2 && strings.HasPrefix(filter, "/") && strings.HasSuffix(filter, "/") {
+		src := filter[1 : len(filter)-1]
+		re, err := regexp.Compile("(?i)" + src)
+		if err != nil {
+			return fmt.Errorf("unsupported regular expression: %v", err)
+		}
+		target.patterns = append(target.patterns, abpPattern{source: src, re: re})
+		return nil
+	}
+
+	var warning error
+	if i := strings.LastIndexByte(filter, '$'); i >= 0 {
+		warning = fmt.Errorf("options %q ignored", filter[i+1:])
+		filter = filter[:i]
+	}
+
+	hostAnchor := strings.HasPrefix(filter, "||")
+	startAnchor := !hostAnchor && strings.HasPrefix(filter, "|")
+	body := strings.TrimPrefix(filter, "|")
+	if hostAnchor {
+		body = body[1:]
+	}
+	endAnchor := strings.HasSuffix(body, "|")
+	body = strings.ToLower(strings.TrimSuffix(body, "|"))
+	if body == "" {
+		return fmt.Errorf("empty filter")
+	}
+
+	// Only the host part can be matched. Blocking filters with a path apply
+	// to the whole host; exceptions with a path would unblock too much.
+	hostStart := 0
+	if i := strings.Index(body, "://"); i >= 0 && !hostAnchor {
+		hostStart = i + 3
+	}
+	if i := strings.IndexByte(body[hostStart:], '/'); i >= 0 {
+		i += hostStart
+		if i == 0 {
+			return fmt.Errorf("path-only filter cannot be matched by host")
+		}
+		if path := body[i+1:]; strings.Trim(path, "*") != "" || endAnchor {
+			if target == &l.allow {
+				return fmt.Errorf("path-specific exception ignored")
+			}
+			body, endAnchor = body[:i+1], false
+		}
+	}
+
+	if hostAnchor && !endAnchor {
+		if d := strings.TrimRight(body, "^/"); len(body)-len(d) <= 1 && abpDomainRegex.MatchString(d) {
+			target.domains[d] = true
+			return warning
+		}
+	}
+
+	src, literal := abpPatternSource(body, hostAnchor, startAnchor, endAnchor)
+	re, err := regexp.Compile("(?i)" + src)
+	if err != nil {
+		return err
+	}
+	target.patterns = append(target.patterns, abpPattern{source: src, literal: literal, re: re})
+	return warning
+}
+
+// abpPatternSource translates a filter body into a regular expression, and
+// returns the longest literal run for prefiltering.
+func abpPatternSource(body string, hostAnchor, startAnchor, endAnchor bool) (string, string) {
+	var b strings.Builder
+	if hostAnchor {
+		b.WriteString(`^[a-z][a-z0-9+.-]*://(?:[^/]+\.)?`)
+	} else if startAnchor {
+		b.WriteString("^")
+	}
+	literal, run := "", ""
+	flush := func() {
+		if len(run) > len(literal) {
+			literal = run
+		}
+		run = ""
+	}
+	for _, c := range body {
+		switch c {
+		case '*':
+			b.WriteString(".*")
+			flush()
+		case '^':
+			b.WriteString(`(?:[^\w.%-]|$)`)
+			flush()
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+			run += string(c)
+		}
+	}
+	flush()
+	if endAnchor {
+		b.WriteString("$")
+	}
+	return b.String(), literal
+}
+
+func (f *abpFilters) match(url, host string) bool {
+	for h := host; ; {
+		if f.domains[h] {
+			return true
+		}
+		i := strings.IndexByte(h, '.')
+		if i < 0 {
+			break
+		}
+		h = h[i+1:]
+	}
+	for _, p := range f.patterns {
+		if p.literal != "" && !strings.Contains(url, p.literal) {
+			continue
+		}
+		if p.re.MatchString(url) {
+			return true
+		}
+	}
+	return false
+}
+
+// Match reports whether connections to host:port are covered by the list.
+func (l *abpList) Match(host string, port int) bool {
+	if l == nil {
+		return false
+	}
+	url := abpURL(host, port)
+	return l.block.match(url, host) && !l.allow.match(url, host)
+}
+
+// Len returns the number of blocking and exception filters.
+func (l *abpList) Len() (int, int) {
+	if l == nil {
+		return 0, 0
+	}
+	return len(l.block.domains) + len(l.block.patterns), len(l.allow.domains) + len(l.allow.patterns)
+}
+
+// abpURL synthesizes the URL filters are matched against: https for port
+// 443, http otherwise.
+func abpURL(host string, port int) string {
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	switch port {
+	case 443:
+		return "https://" + host + "/"
+	case 80, 0:
+		return "http://" + host + "/"
+	}
+	return "http://" + host + ":" + strconv.Itoa(port) + "/"
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxConfigBackups is how many previous versions of the config file are kept.
+const maxConfigBackups = 20
+
+// configBackup describes a previous version of the config file. Time is when
+// that version was saved.
+type configBackup struct {
+	ID   string    `json:"id"`
+	Time time.Time `json:"time"`
+	Size int64     `json:"size"`
+}
+
+func (p *ProxyServer) backupDir() string {
+	return filepath.Join(filepath.Dir(p.configPath), "backups")
+}
+
+// writeConfig replaces the config file atomically, first moving the version
+// it replaces into the backup directory.
+func (p *ProxyServer) writeConfig(data []byte) error {
+	old, err := os.ReadFile(p.configPath)
+	if err == nil && !bytes.Equal(old, data) {
+		if err := p.backupConfig(old); err != nil {
+			p.addLog(fmt.Sprintf("Failed to back up the previous config: %v", err))
+		}
+	}
+	return writeFileAtomic(p.configPath, data, 0644)
+}
+
+// backupConfig stores data, the current content of the config file, as a
+// backup named after the time it was saved, and prunes the oldest backups.
+func (p *ProxyServer) backupConfig(data []byte) error {
+	saved := time.Now()
+	if info, err := os.Stat(p.configPath); err == nil {
+		saved = info.ModTime()
+	}
+	dir := p.backupDir()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	id := "config-" + saved.Format("20060102-150405.000")
+	for n := 2; ; n++ {
+		if _, err := os.Stat(filepath.Join(dir, id+".json")); os.IsNotExist(err) {
+			break
+		}
+		id = fmt.Sprintf("config-%s-%d", saved.Format("20060102-150405.000"), n)
+	}
+	path := filepath.Join(dir, id+".json")
+	if err := writeFileAtomic(path, data, 0644); err != nil {
+		return err
+	}
+	os.Chtimes(path, saved, saved)
+
+	backups, err := p.listConfigBackups()
+	if err != nil {
+		return err
+	}
+	for _, b := range backups[min(len(backups), maxConfigBackups):] {
+		os.Remove(filepath.Join(dir, b.ID+".json"))
+	}
+	return nil
+}
+
+// listConfigBackups returns the stored backups, newest first.
+func (p *ProxyServer) listConfigBackups() ([]configBackup, error) {
+	entries, err := os.ReadDir(p.backupDir())
+	if os.IsNotExist(err) {
+		return []configBackup{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	backups := []configBackup{}
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, "config-") || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		backups = append(backups, configBackup{ID: strings.TrimSuffix(name, ".json"), Time: info.ModTime(), Size: info.Size()})
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].ID > backups[j].ID })
+	return backups, nil
+}
+
+// readConfigBackup returns the content of the backup with the given ID. Only
+// IDs from listConfigBackups are accepted, so the ID cannot escape the
+// backup directory.
+func (p *ProxyServer) readConfigBackup(id string) ([]byte, error) {
+	backups, err := p.listConfigBackups()
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range backups {
+		if b.ID == id {
+			return os.ReadFile(filepath.Join(p.backupDir(), id+".json"))
+		}
+	}
+	return nil, fmt.Errorf("no backup %q: %w", id, os.ErrNotExist)
+}
+
+// diffConfigBackup compares a backup with the current config file.
+func (p *ProxyServer) diffConfigBackup(id string) (string, error) {
+	old, err := p.readConfigBackup(id)
+	if err != nil {
+		return "", err
+	}
+	current, err := os.ReadFile(p.configPath)
+	if err != nil {
+		return "", err
+	}
+	return diffLines(string(old), string(current)), nil
+}
+
+// restoreConfigBackup applies a backup and saves it as the current config.
+// The backup is validated like a saved config; an invalid one is rejected
+// with fieldErrors. The version it replaces is backed up in turn, so a
+// restore can be undone.
+func (p *ProxyServer) restoreConfigBackup(id string) error {
+	data, err := p.readConfigBackup(id)
+	if err != nil {
+		return err
+	}
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return fmt.Errorf("backup %s is not a valid config: %w", id, err)
+	}
+	migrateConfig(&cfg)
+	normalizeConfig(&cfg)
+	if errs := validateConfig(&cfg); len(errs) > 0 {
+		return fieldErrors(errs)
+	}
+	p.configMu.Lock()
+	defer p.configMu.Unlock()
+	if err := p.applyConfig(cfg); err != nil {
+		return err
+	}
+	p.addLog(fmt.Sprintf("Restored config backup %s", id))
+	return p.saveConfig()
+}
+
+// diffLines returns a line diff from a to b in unified style, with three
+// lines of context around each change and "@@" between hunks.
+func diffLines(a, b string) string {
+	x := strings.Split(strings.TrimSuffix(a, "\n"), "\n")
+	y := strings.Split(strings.TrimSuffix(b, "\n"), "\n")
+
+	// Only the part between the common prefix and suffix needs comparing.
+	pre := 0
+	for pre < len(x) && pre < len(y) && x[pre] == y[pre] {
+		pre++
+	}
+	suf := 0
+	for suf < len(x)-pre && suf < len(y)-pre && x[len(x)-1-suf] == y[len(y)-1-suf] {
+		suf++
+	}
+	xm, ym := x[pre:len(x)-suf], y[pre:len(y)-suf]
+
+	var ops []string
+	for _, l := range x[:pre] {
+		ops = append(ops, " "+l)
+	}
+	if len(xm)*len(ym) > 4_000_000 {
+		// Too large to align; show the whole block as replaced.
+		for _, l := range xm {
+			ops = append(ops, "-"+l)
+		}
+		for _, l := range ym {
+			ops = append(ops, "+"+l)
+		}
+	} else {
+		// lcs[i][j] is the length of the longest common subsequence of xm[i:] and ym[j:].
+		lcs := make([][]int, len(xm)+1)
+		for i := range lcs {
+			lcs[i] = make([]int, len(ym)+1)
+		}
+		for i := len(xm) - 1; i >= 0; i-- {
+			for j := len(ym) - 1; j >= 0; j-- {
+				if xm[i] == ym[j] {
+					lcs[i][j] = lcs[i+1][j+1] + 1
+				} else {
+					lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+				}
+			}
+		}
+		i, j := 0, 0
+		for i < len(xm) || j < len(ym) {
+			switch {
+			case i < len(xm) && j < len(ym) && xm[i] == ym[j]:
+				ops = append(ops, " "+xm[i])
+				i, j = i+1, j+1
+			case i < len(xm) && (j == len(ym) || lcs[i+1][j] >= lcs[i][j+1]):
+				ops = append(ops, "-"+xm[i])
+				i++
+			default:
+				ops = append(ops, "+"+ym[j])
+				j++
+			}
+		}
+	}
+	for _, l := range x[len(x)-suf:] {
+		ops = append(ops, " "+l)
+	}
+
+	const context = 3
+	keep := make([]bool, len(ops))
+	for i, op := range ops {
+		if op[0] != ' ' {
+			for k := max(0, i-context); k <= min(len(ops)-1, i+context); k++ {
+				keep[k] = true
+			}
+		}
+	}
+	var out strings.Builder
+	gap := false
+	for i, op := range ops {
+		if !keep[i] {
+			gap = true
+			continue
+		}
+		if gap && out.Len() > 0 {
+			out.WriteString("@@\n")
+		}
+		gap = false
+		out.WriteString(op)
+		out.WriteByte('\n')
+	}
+	return out.String()
+}
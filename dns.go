@@ -0,0 +1,442 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const dnsTimeout = 5 * time.Second
+
+// resolveFunc resolves host for connections leaving through the named outbound.
+type resolveFunc func(outbound, host string) ([]net.IP, error)
+
+// dnsUpstream is a parsed DNS server address. Supported forms are
+// "8.8.8.8", "udp://8.8.8.8:53", "tcp://1.1.1.1", "tls://dns.google" and
+// "https://dns.google/dns-query".
+type dnsUpstream struct {
+	Proto string
+	Addr  string
+	URL   string
+}
+
+func parseDNSUpstream(s string) (dnsUpstream, error) {
+	s = strings.TrimSpace(s)
+	proto, rest, ok := strings.Cut(s, "://")
+	if !ok {
+		proto, rest = "udp", s
+	}
+	switch proto {
+	case "https":
+		u, err := url.Parse(s)
+		if err != nil || u.Host == "" {
+			return dnsUpstream{}, fmt.Errorf("invalid DNS server %q", s)
+		}
+		port := u.Port()
+		if port == "" {
+			port = "443"
+		}
+		return dnsUpstream{Proto: proto, Addr: net.JoinHostPort(u.Hostname(), port), URL: s}, nil
+	case "udp", "tcp", "tls":
+		port := "53"
+		if proto == "tls" {
+			port = "853"
+		}
+		host := rest
+		if h, p, err := net.SplitHostPort(rest); err == nil {
+			host, port = h, p
+		}
+		host = strings.Trim(host, "[]")
+		if host == "" {
+			return dnsUpstream{}, fmt.Errorf("invalid DNS server %q", s)
+		}
+		return dnsUpstream{Proto: proto, Addr: net.JoinHostPort(host, port)}, nil
+	}
+	return dnsUpstream{}, fmt.Errorf("unsupported DNS protocol %q", proto)
+}
+
+// lookupIPs resolves host with the system resolver, or returns it as-is if it
+// is already an IP literal.
+func lookupIPs(host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(context.Background(), host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, a := range addrs {
+		ips = append(ips, a.IP)
+	}
+	return ips, nil
+}
+
+// bootstrapResolve resolves DNS server hostnames with the system resolver, so
+// that reaching a DoH/DoT server never depends on itself.
+func bootstrapResolve(outbound, host string) ([]net.IP, error) {
+	return lookupIPs(host)
+}
+
+type dnsCacheEntry struct {
+	ips     []net.IP
+	expires time.Time
+}
+
+// maxDNSCacheEntries bounds the DNS caches. When one is full, expired
+// entries are dropped, then arbitrary ones down to three quarters; they are
+// simply looked up again.
+const maxDNSCacheEntries = 4096
+
+// dnsCache holds successful lookups until their TTL runs out.
+type dnsCache struct {
+	mu      sync.Mutex
+	entries map[string]dnsCacheEntry
+}
+
+func (c *dnsCache) get(key string) ([]net.IP, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok || time.Now().After(e.expires) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return e.ips, true
+}
+
+func (c *dnsCache) put(key string, ips []net.IP, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]dnsCacheEntry)
+	}
+	now := time.Now()
+	if len(c.entries) >= maxDNSCacheEntries {
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		for k := range c.entries {
+			if len(c.entries) < maxDNSCacheEntries*3/4 {
+				break
+			}
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = dnsCacheEntry{ips: ips, expires: now.Add(ttl)}
+}
+
+func (c *dnsCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = nil
+}
+
+// resolveVia resolves host for a connection leaving through the named
+// outbound. Outbounds with DNS servers query them through the outbound
+// itself; outbounds without use the system resolver, whose nameservers, such
+// as a loopback stub or a LAN resolver, are often unreachable through a VPN
+// interface.
+func (p *ProxyServer) resolveVia(outbound, host string) ([]net.IP, error) {
+	return p.resolveWith(outbound, nil, host)
+}
+
+// resolveWith is resolveVia with DNS servers that take precedence over the
+// outbound's own, as set on split DNS rules.
+func (p *ProxyServer) resolveWith(outbound string, servers []string, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	p.mu.RLock()
+	ob := p.Config.Outbounds[outbound]
+	p.mu.RUnlock()
+
+	if len(servers) == 0 {
+		servers = ob.DNS
+	}
+	if len(servers) == 0 {
+		return lookupIPs(host)
+	}
+
+	key := outbound + "|" + strings.Join(servers, ",") + "|" + strings.ToLower(host)
+	if ips, ok := p.dnsCache.get(key); ok {
+		return ips, nil
+	}
+	ips, ttl, err := p.lookupWithServers(outbound, servers, host)
+	if err != nil {
+		return nil, err
+	}
+	p.dnsCache.put(key, ips, ttl)
+	return ips, nil
+}
+
+// lookupWithServers queries A and AAAA records from the first server that
+// answers. A failed query of one type is ignored when the other returned
+// addresses. The returned TTL is the smallest TTL among the answers.
+func (p *ProxyServer) lookupWithServers(outbound string, servers []string, host string) ([]net.IP, time.Duration, error) {
+	name, err := dnsmessage.NewName(fqdn(host))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var lastErr error = errors.New("no DNS servers")
+	for _, s := range servers {
+		up, err := parseDNSUpstream(s)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		var ips []net.IP
+		var queryErr error
+		ttl := time.Hour
+		for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+			resp, err := p.exchangeDNS(outbound, up, newDNSQuery(name, qtype))
+			if err != nil {
+				queryErr = fmt.Errorf("%s: %w", s, err)
+				continue
+			}
+			found, minTTL := dnsAnswerIPs(resp)
+			ips = append(ips, found...)
+			if len(found) > 0 && minTTL < ttl {
+				ttl = minTTL
+			}
+		}
+		if len(ips) > 0 {
+			return ips, max(ttl, 5*time.Second), nil
+		}
+		if queryErr != nil {
+			lastErr = queryErr
+			continue
+		}
+		return nil, 0, fmt.Errorf("no addresses found for %s", host)
+	}
+	return nil, 0, lastErr
+}
+
+func newDNSQuery(name dnsmessage.Name, qtype dnsmessage.Type) *dnsmessage.Message {
+	// An unpredictable ID makes spoofed answers to plain DNS queries harder.
+	var id [2]byte
+	rand.Read(id[:])
+	return &dnsmessage.Message{
+		Header: dnsmessage.Header{ID: binary.BigEndian.Uint16(id[:]), RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  name,
+			Type:  qtype,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+}
+
+// dnsAnswerIPs extracts A/AAAA addresses and their minimum TTL.
+func dnsAnswerIPs(msg *dnsmessage.Message) ([]net.IP, time.Duration) {
+	var ips []net.IP
+	minTTL := time.Duration(0)
+	for _, ans := range msg.Answers {
+		var ip net.IP
+		switch r := ans.Body.(type) {
+		case *dnsmessage.AResource:
+			ip = net.IP(r.A[:])
+		case *dnsmessage.AAAAResource:
+			ip = net.IP(r.AAAA[:])
+		default:
+			continue
+		}
+		ttl := time.Duration(ans.Header.TTL) * time.Second
+		if len(ips) == 0 || ttl < minTTL {
+			minTTL = ttl
+		}
+		ips = append(ips, ip)
+	}
+	return ips, minTTL
+}
+
+// exchangeDNS sends query to up through the named outbound and returns the
+// parsed response. UDP queries fall back to TCP on truncation, and through
+// proxy outbounds, which cannot carry UDP.
+func (p *ProxyServer) exchangeDNS(outbound string, up dnsUpstream, query *dnsmessage.Message) (*dnsmessage.Message, error) {
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+	raw, err := p.exchangeDNSRaw(outbound, up, packed)
+	if err != nil {
+		return nil, err
+	}
+	var resp dnsmessage.Message
+	if err := resp.Unpack(raw); err != nil {
+		return nil, err
+	}
+	if resp.ID != query.ID {
+		return nil, errors.New("DNS response ID mismatch")
+	}
+	return &resp, nil
+}
+
+func (p *ProxyServer) exchangeDNSRaw(outbound string, up dnsUpstream, query []byte) ([]byte, error) {
+	p.mu.RLock()
+	proxied := p.Config.Outbounds[outbound].isProxy()
+	p.mu.RUnlock()
+
+	switch up.Proto {
+	case "udp":
+		if !proxied {
+			resp, err := p.exchangeUDP(outbound, up.Addr, query)
+			if err != nil || len(resp) < 3 || resp[2]&0x02 == 0 {
+				return resp, err
+			}
+		}
+		return p.exchangeStream(outbound, up, query)
+	case "tcp", "tls":
+		return p.exchangeStream(outbound, up, query)
+	case "https":
+		return p.exchangeDoH(outbound, up, query)
+	}
+	return nil, fmt.Errorf("unsupported DNS protocol %q", up.Proto)
+}
+
+func (p *ProxyServer) exchangeUDP(outbound, addr string, query []byte) ([]byte, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := lookupIPs(host)
+	if err != nil {
+		return nil, err
+	}
+	dialer, ok := p.outboundDialer(outbound, "udp", ips[0])
+	if !ok {
+		return nil, fmt.Errorf("outbound %q has no source address for %s", outbound, host)
+	}
+	conn, err := dialer.Dial("udp", net.JoinHostPort(ips[0].String(), addrPort(addr)))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(dnsTimeout))
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// exchangeStream speaks DNS over TCP or TLS, with two-byte length framing.
+func (p *ProxyServer) exchangeStream(outbound string, up dnsUpstream, query []byte) ([]byte, error) {
+	conn, err := p.dialOutboundWith(outbound, up.Addr, bootstrapResolve)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(dnsTimeout))
+	if up.Proto == "tls" {
+		host, _, _ := net.SplitHostPort(up.Addr)
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: host})
+		if err := tlsConn.Handshake(); err != nil {
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	msg := binary.BigEndian.AppendUint16(nil, uint16(len(query)))
+	if _, err := conn.Write(append(msg, query...)); err != nil {
+		return nil, err
+	}
+	var l [2]byte
+	if _, err := io.ReadFull(conn, l[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(l[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// exchangeDoH posts the query to a DNS-over-HTTPS endpoint (RFC 8484).
+func (p *ProxyServer) exchangeDoH(outbound string, up dnsUpstream, query []byte) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodPost, up.URL, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := p.dohClient(outbound).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH server returned %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 65535))
+}
+
+// dohClient returns the HTTP client used for DoH queries through the named
+// outbound, creating it on first use so connections are reused.
+func (p *ProxyServer) dohClient(outbound string) *http.Client {
+	p.dohMu.Lock()
+	defer p.dohMu.Unlock()
+	if c, ok := p.dohClients[outbound]; ok {
+		return c
+	}
+	if p.dohClients == nil {
+		p.dohClients = make(map[string]*http.Client)
+	}
+	c := &http.Client{
+		Timeout: dnsTimeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return p.dialOutboundWith(outbound, addr, bootstrapResolve)
+			},
+			ForceAttemptHTTP2: true,
+			IdleConnTimeout:   90 * time.Second,
+		},
+	}
+	p.dohClients[outbound] = c
+	return c
+}
+
+// resetResolvers drops cached answers and pooled DoH connections, e.g. after
+// outbounds or their interfaces changed.
+func (p *ProxyServer) resetResolvers() {
+	p.dnsCache.clear()
+	p.dnsResponses.clear()
+	p.dohMu.Lock()
+	defer p.dohMu.Unlock()
+	for _, c := range p.dohClients {
+		c.CloseIdleConnections()
+	}
+	p.dohClients = nil
+}
+
+func fqdn(host string) string {
+	if strings.HasSuffix(host, ".") {
+		return host
+	}
+	return host + "."
+}
+
+func addrPort(addr string) string {
+	_, port, _ := net.SplitHostPort(addr)
+	return port
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// defaultDNSListen is used when the local DNS server is enabled without an address.
+const defaultDNSListen = "127.0.0.1:5353"
+
+// DNSServerConfig controls the optional local DNS server. Each query is
+// routed like a connection to the queried name: it is answered with the DNS
+// servers of the matching rule or outbound, sent through that outbound.
+type DNSServerConfig struct {
+	Enabled bool   `json:"enabled"`
+	Listen  string `json:"listen"`
+}
+
+// startDNSServer listens for DNS queries over UDP and TCP on addr.
+func (p *ProxyServer) startDNSServer(addr string) error {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		pc.Close()
+		return err
+	}
+
+	p.mu.Lock()
+	p.dnsPacketConn, p.dnsListener = pc, ln
+	p.mu.Unlock()
+
+	p.addLog(fmt.Sprintf("DNS server started on %s", addr))
+	go p.serveDNSPackets(pc)
+	go p.serveDNSStreams(ln)
+	return nil
+}
+
+// stopDNSServer closes the DNS listeners. The caller must hold p.mu.
+func (p *ProxyServer) stopDNSServer() {
+	if p.dnsPacketConn != nil {
+		p.dnsPacketConn.Close()
+		p.dnsPacketConn = nil
+	}
+	if p.dnsListener != nil {
+		p.dnsListener.Close()
+		p.dnsListener = nil
+	}
+}
+
+func (p *ProxyServer) serveDNSPackets(pc net.PacketConn) {
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		query := append([]byte(nil), buf[:n]...)
+		go func() {
+			if resp := p.answerDNS(query, true); resp != nil {
+				pc.WriteTo(resp, from)
+			}
+		}()
+	}
+}
+
+func (p *ProxyServer) serveDNSStreams(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go p.handleDNSStream(conn)
+	}
+}
+
+// handleDNSStream answers length-prefixed queries until the client closes
+// the connection or stays idle.
+func (p *ProxyServer) handleDNSStream(conn net.Conn) {
+	defer conn.Close()
+	for {
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		var l [2]byte
+		if _, err := io.ReadFull(conn, l[:]); err != nil {
+			return
+		}
+		query := make([]byte, binary.BigEndian.Uint16(l[:]))
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+		resp := p.answerDNS(query, false)
+		if resp == nil {
+			return
+		}
+		msg := binary.BigEndian.AppendUint16(nil, uint16(len(resp)))
+		if _, err := conn.Write(append(msg, resp...)); err != nil {
+			return
+		}
+	}
+}
+
+// answerDNS returns the packed response to query, or nil if it is not a
+// DNS query at all. UDP responses that exceed the client's advertised
+// payload size are sent truncated so the client retries over TCP.
+func (p *ProxyServer) answerDNS(query []byte, udp bool) []byte {
+	var req dnsmessage.Message
+	if err := req.Unpack(query); err != nil || req.Response {
+		return nil
+	}
+
+	resp := *p.resolveDNSQuery(&req, query)
+	resp.ID = req.ID
+	resp.Response = true
+	resp.RecursionDesired = req.RecursionDesired
+	resp.Questions = req.Questions
+
+	packed, err := resp.Pack()
+	if err != nil {
+		return nil
+	}
+	if limit := udpPayloadLimit(&req); udp && len(packed) > limit {
+		resp.Truncated = true
+		resp.Answers, resp.Authorities, resp.Additionals = nil, nil, nil
+		packed, _ = resp.Pack()
+	}
+	return packed
+}
+
+// resolveDNSQuery answers a single-question query from the cache, the DNS
+// servers its route selects, or the outbound's resolver.
+func (p *ProxyServer) resolveDNSQuery(req *dnsmessage.Message, raw []byte) *dnsmessage.Message {
+	if len(req.Questions) != 1 {
+		return &dnsmessage.Message{Header: dnsmessage.Header{RCode: dnsmessage.RCodeFormatError}}
+	}
+	q := req.Questions[0]
+	name := strings.TrimSuffix(strings.ToLower(q.Name.String()), ".")
+	key := name + "/" + q.Type.String()
+
+	if resp, ok := p.dnsResponses.get(key); ok {
+		p.addLog(fmt.Sprintf("DNS %s %s (cached)", name, dnsTypeName(q.Type)))
+		return resp
+	}
+
+	rt := p.selectRoute(name, 0)
+	servers := rt.DNS
+	if len(servers) == 0 {
+		p.mu.RLock()
+		servers = p.Config.Outbounds[rt.Outbound].DNS
+		p.mu.RUnlock()
+	}
+
+	var resp *dnsmessage.Message
+	var err error
+	if rt.Outbound == OutboundReject {
+		resp = &dnsmessage.Message{Header: dnsmessage.Header{RecursionAvailable: true, RCode: dnsmessage.RCodeNameError}}
+	} else if len(servers) > 0 {
+		resp, err = p.forwardDNSQuery(rt.Outbound, servers, raw)
+	} else {
+		resp, err = p.synthesizeDNSAnswer(rt, q)
+	}
+	if err != nil {
+		p.addLog(fmt.Sprintf("DNS %s %s via %s failed: %v", name, dnsTypeName(q.Type), rt.Outbound, err))
+		return &dnsmessage.Message{Header: dnsmessage.Header{RCode: dnsmessage.RCodeServerFailure}}
+	}
+	p.addLog(fmt.Sprintf("DNS %s %s via %s: %s", name, dnsTypeName(q.Type), rt.Outbound, strings.TrimPrefix(resp.RCode.String(), "RCode")))
+	if ttl, ok := dnsResponseTTL(resp); ok {
+		p.dnsResponses.put(key, resp, ttl)
+	}
+	return resp
+}
+
+// forwardDNSQuery relays the raw query to the first of servers that answers,
+// through the named outbound.
+func (p *ProxyServer) forwardDNSQuery(outbound string, servers []string, raw []byte) (*dnsmessage.Message, error) {
+	var lastErr error = errors.New("no DNS servers")
+	for _, s := range servers {
+		up, err := parseDNSUpstream(s)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		packed, err := p.exchangeDNSRaw(outbound, up, raw)
+		if err != nil {
+			lastErr = fmt.Errorf("%s: %w", s, err)
+			continue
+		}
+		var resp dnsmessage.Message
+		if err := resp.Unpack(packed); err != nil {
+			lastErr = fmt.Errorf("%s: %w", s, err)
+			continue
+		}
+		return &resp, nil
+	}
+	return nil, lastErr
+}
+
+// synthesizeDNSAnswer answers A and AAAA queries with the outbound's
+// resolver when no DNS servers are configured. Other record types, such as
+// the HTTPS queries browsers send alongside every lookup, cannot be looked up
+// that way and get an empty answer (NODATA).
+func (p *ProxyServer) synthesizeDNSAnswer(rt route, q dnsmessage.Question) (*dnsmessage.Message, error) {
+	resp := &dnsmessage.Message{Header: dnsmessage.Header{RecursionAvailable: true}}
+	if q.Type != dnsmessage.TypeA && q.Type != dnsmessage.TypeAAAA {
+		return resp, nil
+	}
+	ips, err := p.resolveWith(rt.Outbound, nil, strings.TrimSuffix(q.Name.String(), "."))
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			resp.RCode = dnsmessage.RCodeNameError
+			return resp, nil
+		}
+		return nil, err
+	}
+
+	hdr := dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: dnsmessage.ClassINET, TTL: 60}
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil && q.Type == dnsmessage.TypeA {
+			r := &dnsmessage.AResource{}
+			copy(r.A[:], ip4)
+			resp.Answers = append(resp.Answers, dnsmessage.Resource{Header: hdr, Body: r})
+		} else if ip4 == nil && q.Type == dnsmessage.TypeAAAA {
+			r := &dnsmessage.AAAAResource{}
+			copy(r.AAAA[:], ip.To16())
+			resp.Answers = append(resp.Answers, dnsmessage.Resource{Header: hdr, Body: r})
+		}
+	}
+	return resp, nil
+}
+
+// dnsResponseTTL returns how long resp may be cached: the smallest TTL of its
+// records. Only successful and NXDOMAIN responses with records are cacheable.
+func dnsResponseTTL(resp *dnsmessage.Message) (time.Duration, bool) {
+	if resp.RCode != dnsmessage.RCodeSuccess && resp.RCode != dnsmessage.RCodeNameError {
+		return 0, false
+	}
+	var ttl uint32
+	found := false
+	for _, section := range [][]dnsmessage.Resource{resp.Answers, resp.Authorities} {
+		for _, r := range section {
+			if !found || r.Header.TTL < ttl {
+				ttl, found = r.Header.TTL, true
+			}
+		}
+	}
+	return time.Duration(ttl) * time.Second, found && ttl > 0
+}
+
+// udpPayloadLimit returns the UDP response size the client accepts: the
+// EDNS0 payload size if it sent one, else the classic 512 bytes.
+func udpPayloadLimit(req *dnsmessage.Message) int {
+	for _, r := range req.Additionals {
+		if r.Header.Type == dnsmessage.TypeOPT && int(r.Header.Class) > 512 {
+			return int(r.Header.Class)
+		}
+	}
+	return 512
+}
+
+func dnsTypeName(t dnsmessage.Type) string {
+	return strings.TrimPrefix(t.String(), "Type")
+}
+
+type dnsResponseEntry struct {
+	msg     *dnsmessage.Message
+	stored  time.Time
+	expires time.Time
+}
+
+// dnsResponseCache holds local DNS server responses until their TTL runs out.
+// Hits have their TTLs reduced by the time spent in the cache.
+type dnsResponseCache struct {
+	mu      sync.Mutex
+	entries map[string]dnsResponseEntry
+}
+
+func (c *dnsResponseCache) get(key string) (*dnsmessage.Message, bool) {
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	if ok && time.Now().After(e.expires) {
+		delete(c.entries, key)
+		ok = false
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	elapsed := uint32(time.Since(e.stored) / time.Second)
+	msg := *e.msg
+	msg.Answers = agedResources(msg.Answers, elapsed)
+	msg.Authorities = agedResources(msg.Authorities, elapsed)
+	msg.Additionals = agedResources(msg.Additionals, elapsed)
+	return &msg, true
+}
+
+func (c *dnsResponseCache) put(key string, msg *dnsmessage.Message, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]dnsResponseEntry)
+	}
+	now := time.Now()
+	if len(c.entries) >= maxDNSCacheEntries {
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		for k := range c.entries {
+			if len(c.entries) < maxDNSCacheEntries*3/4 {
+				break
+			}
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = dnsResponseEntry{msg: msg, stored: now, expires: now.Add(ttl)}
+}
+
+func (c *dnsResponseCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = nil
+}
+
+// agedResources copies rs with elapsed seconds taken off each TTL. EDNS0 OPT
+// records are left alone, as their TTL field carries flags.
+func agedResources(rs []dnsmessage.Resource, elapsed uint32) []dnsmessage.Resource {
+	aged := make([]dnsmessage.Resource, len(rs))
+	for i, r := range rs {
+		if r.Header.Type != dnsmessage.TypeOPT {
+			r.Header.TTL -= min(r.Header.TTL, elapsed)
+		}
+		aged[i] = r
+	}
+	return aged
+}
@@ -0,0 +1,40 @@
+//go:build darwin
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+)
+
+// defaultGateway returns the IPv4 default gateway and the interface of the
+// default route, as reported by `route -n get default`.
+func defaultGateway() (net.IP, string, error) {
+	out, err := exec.Command("route", "-n", "get", "default").Output()
+	if err != nil {
+		return nil, "", err
+	}
+	var gateway net.IP
+	var iface string
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "gateway":
+			gateway = net.ParseIP(strings.TrimSpace(value))
+		case "interface":
+			iface = strings.TrimSpace(value)
+		}
+	}
+	if iface == "" {
+		return nil, "", fmt.Errorf("no default route")
+	}
+	return gateway, iface, nil
+}
@@ -0,0 +1,56 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// defaultGateway returns the IPv4 default gateway and the interface of the
+// default route, read from /proc/net/route. The route with the lowest metric
+// wins when there are several.
+func defaultGateway() (net.IP, string, error) {
+	f, err := os.Open("/proc/net/route")
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+
+	var gateway net.IP
+	var iface string
+	bestMetric := -1
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 8 || fields[1] != "00000000" || fields[7] != "00000000" {
+			continue
+		}
+		var metric int
+		fmt.Sscan(fields[6], &metric)
+		if bestMetric >= 0 && metric >= bestMetric {
+			continue
+		}
+		raw, err := hex.DecodeString(fields[2])
+		if err != nil || len(raw) != 4 {
+			continue
+		}
+		// The kernel prints the address as a number in host byte order.
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, binary.NativeEndian.Uint32(raw))
+		gateway, iface, bestMetric = ip, fields[0], metric
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, "", err
+	}
+	if iface == "" {
+		return nil, "", fmt.Errorf("no default route")
+	}
+	return gateway, iface, nil
+}
@@ -0,0 +1,12 @@
+//go:build !darwin && !linux && !windows
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+func defaultGateway() (net.IP, string, error) {
+	return nil, "", errors.New("default gateway lookup is not supported on this platform")
+}
@@ -0,0 +1,58 @@
+//go:build windows
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+// defaultGateway returns the IPv4 default gateway and the interface of the
+// default route, parsed from `route print -4 0.0.0.0`. Windows reports the
+// interface by its address, so the interface name is looked up from it.
+func defaultGateway() (net.IP, string, error) {
+	cmd := exec.Command("route", "print", "-4", "0.0.0.0")
+	cmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: true}
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, "", err
+	}
+	var gateway, local net.IP
+	bestMetric := -1
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		// Network Destination, Netmask, Gateway, Interface, Metric
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 5 || fields[0] != "0.0.0.0" || fields[1] != "0.0.0.0" {
+			continue
+		}
+		var metric int
+		fmt.Sscan(fields[4], &metric)
+		gw, addr := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+		if gw == nil || addr == nil || (bestMetric >= 0 && metric >= bestMetric) {
+			continue
+		}
+		gateway, local, bestMetric = gw, addr, metric
+	}
+	if local == nil {
+		return nil, "", fmt.Errorf("no default route")
+	}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return gateway, "", err
+	}
+	for _, iface := range ifaces {
+		addrs, _ := iface.Addrs()
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.Equal(local) {
+				return gateway, iface.Name, nil
+			}
+		}
+	}
+	return gateway, "", nil
+}
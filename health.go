@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// HealthCheck probes an outbound in the background. While its probes fail,
+// the outbound is down and rules with a fallback use the fallback instead.
+type HealthCheck struct {
+	Type     string `json:"type"`               // HealthCheckTCP or HealthCheckHTTP
+	Target   string `json:"target"`             // host:port for TCP, an http(s) URL for HTTP
+	Interval int    `json:"interval,omitempty"` // seconds between probes
+}
+
+// Health check types.
+const (
+	HealthCheckTCP  = "tcp"
+	HealthCheckHTTP = "http"
+)
+
+const (
+	defaultHealthInterval = 30
+	minHealthInterval     = 5
+	healthCheckTimeout    = 10 * time.Second
+	// healthFailuresDown is how many probes in a row must fail before an
+	// outbound is down, so a single lost probe does not cause a failover. One
+	// successful probe brings it back up.
+	healthFailuresDown = 2
+)
+
+// outboundHealth is the probe state of an outbound, guarded by p.healthMu.
+type outboundHealth struct {
+	check     HealthCheck // the check this state belongs to
+	down      bool
+	failures  int // consecutive failed probes
+	probing   bool
+	checked   time.Time
+	since     time.Time // when the outbound last went up or down
+	latency   time.Duration
+	lastError string
+}
+
+// healthStatus is an outbound's health as reported by /api/health.
+type healthStatus struct {
+	Outbound  string    `json:"outbound"`
+	Iface     string    `json:"iface,omitempty"` // interface in use
+	Check     string    `json:"check,omitempty"` // e.g. "tcp example.com:443"
+	State     string    `json:"state"`           // "up", "down", "pending" or "unchecked"
+	Since     time.Time `json:"since"`
+	Checked   time.Time `json:"checked"`
+	LatencyMs int64     `json:"latencyMs,omitempty"`
+	LastError string    `json:"lastError,omitempty"`
+}
+
+// outboundUp reports whether the named outbound can carry traffic: its
+// interface is not missing, and it passes its health check. Outbounds
+// without a check, or not yet probed, count as up.
+func (p *ProxyServer) outboundUp(name string) bool {
+	p.mu.RLock()
+	missing := p.ifaceMissing(name)
+	p.mu.RUnlock()
+	if missing {
+		return false
+	}
+
+	p.healthMu.Lock()
+	defer p.healthMu.Unlock()
+	h := p.health[name]
+	return h == nil || !h.down
+}
+
+// runHealthChecker probes every outbound that has a health check on its own
+// interval. State is reset when an outbound's check changes or is removed.
+func (p *ProxyServer) runHealthChecker() {
+	for ; ; time.Sleep(time.Second) {
+		p.mu.RLock()
+		checks := make(map[string]HealthCheck)
+		for name, ob := range p.Config.Outbounds {
+			if ob.HealthCheck != nil {
+				checks[name] = *ob.HealthCheck
+			}
+		}
+		p.mu.RUnlock()
+
+		p.healthMu.Lock()
+		if p.health == nil {
+			p.health = make(map[string]*outboundHealth)
+		}
+		for name, h := range p.health {
+			if c, ok := checks[name]; !ok || c != h.check {
+				delete(p.health, name)
+			}
+		}
+		for name, c := range checks {
+			h := p.health[name]
+			if h == nil {
+				h = &outboundHealth{check: c}
+				p.health[name] = h
+			}
+			interval := c.Interval
+			if interval <= 0 {
+				interval = defaultHealthInterval
+			}
+			if h.probing || time.Since(h.checked) < time.Duration(interval)*time.Second {
+				continue
+			}
+			h.probing = true
+			go p.probeOutbound(name, c)
+		}
+		p.healthMu.Unlock()
+	}
+}
+
+// probeOutbound runs one health check and records its result.
+func (p *ProxyServer) probeOutbound(name string, c HealthCheck) {
+	start := time.Now()
+	err := p.runHealthCheck(name, c)
+	latency := time.Since(start)
+
+	p.healthMu.Lock()
+	h := p.health[name]
+	if h == nil || h.check != c {
+		p.healthMu.Unlock()
+		return // the check was changed or removed meanwhile
+	}
+	wasDown, first := h.down, h.checked.IsZero()
+	h.probing = false
+	h.checked = time.Now()
+	if err == nil {
+		h.failures, h.down, h.latency, h.lastError = 0, false, latency, ""
+	} else {
+		h.failures++
+		h.lastError = err.Error()
+		h.down = h.down || h.failures >= healthFailuresDown
+	}
+	if first || h.down != wasDown {
+		h.since = h.checked
+	}
+	down := h.down
+	p.healthMu.Unlock()
+
+	switch {
+	case down && !wasDown:
+		p.addLog(fmt.Sprintf("Outbound %s is down: %v", name, err))
+	case !down && wasDown:
+		p.addLog(fmt.Sprintf("Outbound %s is up again (%d ms)", name, latency.Milliseconds()))
+	}
+}
+
+// runHealthCheck probes through the outbound itself, so the check covers its
+// interface, DNS and upstream proxy. HTTP checks pass on any status below 500.
+func (p *ProxyServer) runHealthCheck(name string, c HealthCheck) error {
+	if c.Type != HealthCheckHTTP {
+		conn, err := p.dialOutbound(name, c.Target)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return p.dialOutbound(name, addr)
+		},
+	}
+	defer transport.CloseIdleConnections()
+	client := &http.Client{
+		Timeout:   healthCheckTimeout,
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Get(c.Target)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("server returned %s", resp.Status)
+	}
+	return nil
+}
+
+// healthStatuses reports the health of every outbound, in name order.
+func (p *ProxyServer) healthStatuses() []healthStatus {
+	p.mu.RLock()
+	statuses := make([]healthStatus, 0, len(p.Config.Outbounds))
+	for name, ob := range p.Config.Outbounds {
+		s := healthStatus{Outbound: name, State: "unchecked"}
+		if !ob.isProxy() {
+			s.Iface = p.outboundIface(name)
+		}
+		if ob.HealthCheck != nil {
+			s.Check = ob.HealthCheck.Type + " " + ob.HealthCheck.Target
+			s.State = "pending"
+		}
+		statuses = append(statuses, s)
+	}
+	p.mu.RUnlock()
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Outbound < statuses[j].Outbound })
+
+	p.healthMu.Lock()
+	defer p.healthMu.Unlock()
+	for i := range statuses {
+		s := &statuses[i]
+		h := p.health[s.Outbound]
+		if s.Check == "" || h == nil || h.checked.IsZero() {
+			continue
+		}
+		s.State = "up"
+		if h.down {
+			s.State = "down"
+		}
+		s.Since, s.Checked, s.LastError = h.since, h.checked, h.lastError
+		s.LatencyMs = h.latency.Milliseconds()
+	}
+	return statuses
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// hopHeaders are the hop-by-hop headers (RFC 7230, section 6.1) that a proxy
+// must not forward, plus the non-standard Proxy-Connection.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopHeaders deletes hop-by-hop headers, including those named in the
+// Connection header.
+func removeHopHeaders(h http.Header) {
+	for _, v := range h.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			h.Del(strings.TrimSpace(name))
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// handleHTTPConnection serves an HTTP proxy client: CONNECT requests are
+// tunnelled, and absolute-URI requests are forwarded, reusing the connection
+// for as long as both sides keep it alive.
+func (p *ProxyServer) handleHTTPConnection(client net.Conn) {
+	defer client.Close()
+	br := bufio.NewReader(client)
+	for {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+		if !p.authorizeHTTP(client, req) {
+			return
+		}
+		if req.Method == http.MethodConnect {
+			p.handleHTTPConnect(&bufferedConn{Conn: client, r: br}, req)
+			return
+		}
+		if !p.forwardHTTP(client, req) {
+			return
+		}
+	}
+}
+
+// authorizeHTTP checks Proxy-Authorization against the configured users and
+// answers 407 when they do not match.
+func (p *ProxyServer) authorizeHTTP(client net.Conn, req *http.Request) bool {
+	p.mu.RLock()
+	users := p.Config.Auth.Users
+	p.mu.RUnlock()
+	if len(users) == 0 {
+		return true
+	}
+
+	username, password, ok := parseProxyAuth(req.Header.Get("Proxy-Authorization"))
+	if ok && checkCredentials(users, username, password) {
+		return true
+	}
+	if ok {
+		p.addLog(fmt.Sprintf("HTTP proxy authentication failed for user %q from %s", username, client.RemoteAddr()))
+	}
+	io.WriteString(client, "HTTP/1.1 407 Proxy Authentication Required\r\n"+
+		"Proxy-Authenticate: Basic realm=\"SmartProxy\"\r\n"+
+		"Content-Length: 0\r\n\r\n")
+	return false
+}
+
+// parseProxyAuth decodes a Basic Proxy-Authorization header.
+func parseProxyAuth(header string) (string, string, bool) {
+	scheme, encoded, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(decoded), ":")
+}
+
+func (p *ProxyServer) handleHTTPConnect(client net.Conn, req *http.Request) {
+	host, port, err := splitHostPortDefault(req.Host, 443)
+	if err != nil {
+		io.WriteString(client, "HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\n\r\n")
+		return
+	}
+	remote, err := p.dialRoute(host, port)
+	if errors.Is(err, errRejected) {
+		io.WriteString(client, "HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n")
+		return
+	} else if err != nil {
+		io.WriteString(client, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n")
+		return
+	}
+	defer remote.Close()
+	io.WriteString(client, "HTTP/1.1 200 Connection Established\r\n\r\n")
+	relay(client, remote)
+}
+
+// forwardHTTP sends an absolute-URI request to its origin through the routed
+// outbound and writes the response back. It reports whether the client
+// connection can carry another request.
+func (p *ProxyServer) forwardHTTP(client net.Conn, req *http.Request) bool {
+	if req.URL.Host == "" || (req.URL.Scheme != "http" && req.URL.Scheme != "https") {
+		io.WriteString(client, "HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+		return false
+	}
+	keepAlive := !req.Close && !strings.EqualFold(req.Header.Get("Proxy-Connection"), "close")
+
+	req.RequestURI = ""
+	removeHopHeaders(req.Header)
+	resp, err := p.httpTransport().RoundTrip(req)
+	if errors.Is(err, errRejected) {
+		p.addLog(fmt.Sprintf("Rejected %s", req.URL.Host))
+		io.WriteString(client, "HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+		return false
+	} else if err != nil {
+		p.addLog(fmt.Sprintf("HTTP request to %s failed: %v", req.URL.Host, err))
+		io.WriteString(client, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+		return false
+	}
+	defer resp.Body.Close()
+
+	removeHopHeaders(resp.Header)
+	if resp.ContentLength < 0 && len(resp.TransferEncoding) == 0 {
+		// The body is delimited by closing the connection.
+		keepAlive = false
+	}
+	resp.Close = !keepAlive
+	if err := resp.Write(client); err != nil {
+		return false
+	}
+	return keepAlive
+}
+
+// httpTransport returns the transport used for plain HTTP forwarding. It
+// dials every origin through the outbound its host:port routes to.
+func (p *ProxyServer) httpTransport() *http.Transport {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.httpForwarder == nil {
+		p.httpForwarder = &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				host, port, err := splitHostPortDefault(addr, 80)
+				if err != nil {
+					return nil, err
+				}
+				rt := p.selectRoute(host, port)
+				return p.dialOutboundWith(rt.Outbound, addr, rt.resolver(p))
+			},
+			DisableCompression:    true,
+			IdleConnTimeout:       90 * time.Second,
+			ResponseHeaderTimeout: 60 * time.Second,
+		}
+	}
+	return p.httpForwarder
+}
+
+// splitHostPortDefault splits addr, using defaultPort when it has none.
+func splitHostPortDefault(addr string, defaultPort int) (string, int, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, portStr = strings.Trim(addr, "[]"), strconv.Itoa(defaultPort)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || host == "" || port <= 0 || port > 65535 {
+		return "", 0, fmt.Errorf("invalid address %q", addr)
+	}
+	return host, port, nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"strings"
+)
+
+// IfaceMatch selects an outbound's interface by its properties instead of a
+// fixed name, for VPN clients that hand out utun6 today and utun8 tomorrow.
+// All non-empty conditions must hold. Only interfaces that are up and have
+// an IPv4 or global IPv6 address are considered; among several, the first
+// one the system lists is used.
+type IfaceMatch struct {
+	Name  string   `json:"name,omitempty"`  // glob such as "utun*"
+	CIDR  string   `json:"cidr,omitempty"`  // network holding one of its addresses, e.g. 10.8.0.0/16
+	MTU   int      `json:"mtu,omitempty"`   // exact MTU
+	Flags []string `json:"flags,omitempty"` // flags that must be set, e.g. "pointtopoint"
+}
+
+// ifaceFlags maps the flag names accepted in IfaceMatch.Flags.
+var ifaceFlags = map[string]net.Flags{
+	"up":           net.FlagUp,
+	"broadcast":    net.FlagBroadcast,
+	"pointtopoint": net.FlagPointToPoint,
+	"multicast":    net.FlagMulticast,
+	"running":      net.FlagRunning,
+}
+
+func (m *IfaceMatch) String() string {
+	var parts []string
+	if m.Name != "" {
+		parts = append(parts, "name "+m.Name)
+	}
+	if m.CIDR != "" {
+		parts = append(parts, "address in "+m.CIDR)
+	}
+	if m.MTU != 0 {
+		parts = append(parts, fmt.Sprintf("MTU %d", m.MTU))
+	}
+	if len(m.Flags) > 0 {
+		parts = append(parts, "flags "+strings.Join(m.Flags, ","))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// validate returns a problem with the conditions, if any.
+func (m *IfaceMatch) validate() error {
+	if m.Name == "" && m.CIDR == "" && m.MTU == 0 && len(m.Flags) == 0 {
+		return fmt.Errorf("at least one condition is required")
+	}
+	if _, err := path.Match(m.Name, ""); err != nil {
+		return fmt.Errorf("invalid name pattern %q", m.Name)
+	}
+	if m.CIDR != "" {
+		if _, _, err := net.ParseCIDR(m.CIDR); err != nil {
+			return fmt.Errorf("invalid CIDR %q", m.CIDR)
+		}
+	}
+	if m.MTU < 0 {
+		return fmt.Errorf("MTU must not be negative")
+	}
+	for _, f := range m.Flags {
+		if _, ok := ifaceFlags[f]; !ok {
+			return fmt.Errorf("unknown flag %q", f)
+		}
+	}
+	return nil
+}
+
+func (m *IfaceMatch) matches(iface net.Interface, addrs []net.Addr) bool {
+	if m.Name != "" {
+		if ok, _ := path.Match(m.Name, iface.Name); !ok {
+			return false
+		}
+	}
+	if m.MTU != 0 && iface.MTU != m.MTU {
+		return false
+	}
+	for _, f := range m.Flags {
+		if iface.Flags&ifaceFlags[f] == 0 {
+			return false
+		}
+	}
+	if m.CIDR != "" {
+		_, cidr, err := net.ParseCIDR(m.CIDR)
+		if err != nil {
+			return false
+		}
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok && cidr.Contains(ipnet.IP) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// findIface returns the name of the interface selected by m, or an error if
+// none matches.
+func findIface(m *IfaceMatch, ifaces []net.Interface) (string, error) {
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		usable := false
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok && (ipnet.IP.To4() != nil || ipnet.IP.IsGlobalUnicast()) && !ipnet.IP.IsLoopback() {
+				usable = true
+				break
+			}
+		}
+		if usable && m.matches(iface, addrs) {
+			return iface.Name, nil
+		}
+	}
+	return "", fmt.Errorf("no interface matches %s", m)
+}
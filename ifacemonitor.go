@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// ifacePollInterval is how often interfaces are compared when the
+	// platform cannot report changes.
+	ifacePollInterval = 5 * time.Second
+	// ifaceSettleDelay lets the burst of events of one change, such as a VPN
+	// reconnecting, arrive before interfaces are looked up again.
+	ifaceSettleDelay = 500 * time.Millisecond
+)
+
+// runInterfaceMonitor refreshes the outbound interfaces whenever the system's
+// interfaces, addresses or routes change, using the platform's change events
+// or, where they are unavailable, polling.
+func (p *ProxyServer) runInterfaceMonitor() {
+	events := make(chan struct{}, 1)
+	changed := func() {
+		select {
+		case events <- struct{}{}:
+		default:
+		}
+	}
+	go func() {
+		err := watchInterfaceEvents(changed)
+		p.addLog(fmt.Sprintf("Interface change events unavailable (%v), polling every %v", err, ifacePollInterval))
+		pollInterfaces(changed)
+	}()
+
+	for range events {
+		time.Sleep(ifaceSettleDelay)
+		select {
+		case <-events:
+		default:
+		}
+		p.refreshInterfaces()
+		select {
+		case p.networkChanged <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// pollInterfaces calls changed whenever the interfaces or their addresses
+// differ from the previous poll.
+func pollInterfaces(changed func()) {
+	last := interfaceFingerprint()
+	for range time.Tick(ifacePollInterval) {
+		if fp := interfaceFingerprint(); fp != last {
+			last = fp
+			changed()
+		}
+	}
+}
+
+func interfaceFingerprint() string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return ""
+	}
+	var b strings.Builder
+	for _, iface := range ifaces {
+		addrs, _ := iface.Addrs()
+		fmt.Fprintf(&b, "%d %s %v %v;", iface.Index, iface.Name, iface.Flags, addrs)
+	}
+	return b.String()
+}
+
+// refreshInterfaces looks up the outbound interfaces again and, if any
+// changed, swaps in the new index and address tables under p.mu, so every
+// later dial binds to the current interface.
+func (p *ProxyServer) refreshInterfaces() {
+	p.mu.Lock()
+	old, oldUsed := p.interfaces()
+	current, used, _ := lookupOutboundIfaces(p.Config.Outbounds)
+	if maps.Equal(old, current) && maps.Equal(oldUsed, used) {
+		p.mu.Unlock()
+		return
+	}
+	p.setInterfaces(current, used)
+	var matched []string
+	for name, ob := range p.Config.Outbounds {
+		if ob.IfaceMatch != nil && oldUsed[name] != used[name] {
+			if used[name] == "" {
+				matched = append(matched, fmt.Sprintf("Outbound %s: no interface matches %s", name, ob.IfaceMatch))
+			} else {
+				matched = append(matched, fmt.Sprintf("Outbound %s now uses interface %s", name, used[name]))
+			}
+		}
+	}
+	sort.Strings(matched)
+	notify := p.Config.NotifyInterfaceChanges
+	p.mu.Unlock()
+
+	changes := append(describeInterfaceChanges(old, current), matched...)
+	for _, c := range changes {
+		p.addLog(c)
+	}
+	if notify && p.onInterfaceChange != nil {
+		p.onInterfaceChange(strings.Join(changes, "; "))
+	}
+}
+
+// describeInterfaceChanges lists the differences between two interface
+// tables, one line per interface.
+func describeInterfaceChanges(old, current map[string]ifaceState) []string {
+	names := make([]string, 0, len(old)+len(current))
+	for name := range old {
+		names = append(names, name)
+	}
+	for name := range current {
+		if _, ok := old[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	addrs := func(s ifaceState) string {
+		a := []string{}
+		for _, ip := range []string{s.ip4, s.ip6} {
+			if ip != "" {
+				a = append(a, ip)
+			}
+		}
+		if len(a) == 0 {
+			return "no address"
+		}
+		return strings.Join(a, ", ")
+	}
+	var changes []string
+	for _, name := range names {
+		o, wasUp := old[name]
+		c, isUp := current[name]
+		switch {
+		case !isUp:
+			changes = append(changes, "Interface "+name+" is gone")
+		case !wasUp:
+			changes = append(changes, fmt.Sprintf("Interface %s is available (index %d, %s)", name, c.index, addrs(c)))
+		case o != c:
+			var diffs []string
+			if o.index != c.index {
+				diffs = append(diffs, fmt.Sprintf("index %d -> %d", o.index, c.index))
+			}
+			if addrs(o) != addrs(c) {
+				diffs = append(diffs, addrs(o)+" -> "+addrs(c))
+			}
+			changes = append(changes, "Interface "+name+" changed: "+strings.Join(diffs, ", "))
+		}
+	}
+	return changes
+}
@@ -0,0 +1,34 @@
+//go:build darwin
+
+package main
+
+import "syscall"
+
+// watchInterfaceEvents calls changed for every routing socket message about
+// interfaces, addresses or routes. It returns only when the events cannot be
+// read.
+func watchInterfaceEvents(changed func()) error {
+	fd, err := syscall.Socket(syscall.AF_ROUTE, syscall.SOCK_RAW, syscall.AF_UNSPEC)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := syscall.Read(fd, buf)
+		if err == syscall.EINTR {
+			continue
+		} else if err != nil {
+			return err
+		}
+		// The message type follows the 16-bit length and the version.
+		if n < 4 {
+			continue
+		}
+		switch buf[3] {
+		case syscall.RTM_ADD, syscall.RTM_DELETE, syscall.RTM_CHANGE,
+			syscall.RTM_NEWADDR, syscall.RTM_DELADDR, syscall.RTM_IFINFO:
+			changed()
+		}
+	}
+}
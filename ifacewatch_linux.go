@@ -0,0 +1,43 @@
+//go:build linux
+
+package main
+
+import "syscall"
+
+// rtnetlink multicast groups, from linux/rtnetlink.h.
+const (
+	rtmgrpLink       = 0x1
+	rtmgrpIPv4Ifaddr = 0x10
+	rtmgrpIPv4Route  = 0x40
+	rtmgrpIPv6Ifaddr = 0x100
+)
+
+// watchInterfaceEvents calls changed for every rtnetlink message about links,
+// addresses or IPv4 routes. It returns only when the events cannot be read.
+func watchInterfaceEvents(changed func()) error {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	sa := &syscall.SockaddrNetlink{
+		Family: syscall.AF_NETLINK,
+		Groups: rtmgrpLink | rtmgrpIPv4Ifaddr | rtmgrpIPv6Ifaddr | rtmgrpIPv4Route,
+	}
+	if err := syscall.Bind(fd, sa); err != nil {
+		return err
+	}
+	buf := make([]byte, 64*1024)
+	for {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		switch {
+		case err == syscall.EINTR:
+		case err == syscall.ENOBUFS:
+			changed() // the socket overflowed and events were lost
+		case err != nil:
+			return err
+		case n > 0:
+			changed()
+		}
+	}
+}
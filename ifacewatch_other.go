@@ -0,0 +1,9 @@
+//go:build !darwin && !linux
+
+package main
+
+import "errors"
+
+func watchInterfaceEvents(changed func()) error {
+	return errors.New("not supported on this platform")
+}
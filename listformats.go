@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Rule list formats.
+const (
+	ListFormatABP     = "abp"
+	ListFormatDomains = "domains"
+	ListFormatClash   = "clash"
+	ListFormatDnsmasq = "dnsmasq"
+)
+
+// listMatcher is a compiled rule list.
+type listMatcher interface {
+	// Match reports whether connections to host:port are covered by the list.
+	Match(host string, port int) bool
+	// Len returns the number of entries and of exceptions.
+	Len() (int, int)
+}
+
+// parseRuleList compiles raw list content in the given format. It returns
+// per-line warnings for entries that were skipped.
+func parseRuleList(format string, raw []byte) (listMatcher, []string, error) {
+	content := string(raw)
+	switch format {
+	case ListFormatABP, "":
+		if decoded, err := base64.StdEncoding.DecodeString(content); err == nil {
+			content = string(decoded)
+		}
+		l := parseABP(content)
+		return l, l.Warnings, nil
+	case ListFormatDomains:
+		l := parseDomainList(content)
+		return l, l.warnings, nil
+	case ListFormatClash:
+		l := parseClashProvider(content)
+		return l, l.warnings, nil
+	case ListFormatDnsmasq:
+		l := parseDnsmasqConf(content)
+		return l, l.warnings, nil
+	}
+	return nil, nil, fmt.Errorf("unknown list format %q", format)
+}
+
+// domainList matches hosts by domain suffix, exact name, keyword or, for IP
+// literals, CIDR. It backs the plain, Clash and dnsmasq formats.
+type domainList struct {
+	suffixes map[string]bool
+	exact    map[string]bool
+	keywords []string
+	cidrs    []*net.IPNet
+	warnings []string
+}
+
+func newDomainList() *domainList {
+	return &domainList{suffixes: make(map[string]bool), exact: make(map[string]bool)}
+}
+
+func (l *domainList) warn(n int, line, msg string) {
+	l.warnings = append(l.warnings, fmt.Sprintf("line %d: %s: %s", n, line, msg))
+}
+
+// addDomain adds a suffix entry, accepting "example.com", ".example.com"
+// and "*.example.com" forms.
+func (l *domainList) addDomain(d string) bool {
+	d = strings.TrimPrefix(strings.TrimPrefix(strings.ToLower(d), "*"), ".")
+	if !abpDomainRegex.MatchString(d) {
+		return false
+	}
+	l.suffixes[d] = true
+	return true
+}
+
+func (l *domainList) Match(host string, port int) bool {
+	if ip := net.ParseIP(host); ip != nil {
+		for _, n := range l.cidrs {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	if l.exact[host] {
+		return true
+	}
+	for h := host; ; {
+		if l.suffixes[h] {
+			return true
+		}
+		i := strings.IndexByte(h, '.')
+		if i < 0 {
+			break
+		}
+		h = h[i+1:]
+	}
+	for _, k := range l.keywords {
+		if strings.Contains(host, k) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *domainList) Len() (int, int) {
+	return len(l.suffixes) + len(l.exact) + len(l.keywords) + len(l.cidrs), 0
+}
+
+// listLines calls fn with each non-empty line that is not a # comment.
+func listLines(content string, fn func(n int, line string)) {
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fn(n, line)
+	}
+}
+
+// parseDomainList reads one domain per line, matching it and its subdomains.
+// IP networks in CIDR notation are accepted as well.
+func parseDomainList(content string) *domainList {
+	l := newDomainList()
+	listLines(content, func(n int, line string) {
+		if _, ipnet, err := net.ParseCIDR(line); err == nil {
+			l.cidrs = append(l.cidrs, ipnet)
+		} else if !l.addDomain(line) {
+			l.warn(n, line, "not a domain")
+		}
+	})
+	return l
+}
+
+// parseClashProvider reads the payload of a Clash rule provider in any of its
+// behaviors: classical ("DOMAIN-SUFFIX,example.com"), domain ("+.example.com")
+// or ipcidr ("10.0.0.0/8"). Only the payload list is read, up to the next line
+// that is not a list item, so no YAML library is needed.
+func parseClashProvider(content string) *domainList {
+	l := newDomainList()
+	inPayload := false
+	listLines(content, func(n int, line string) {
+		if strings.HasPrefix(line, "payload:") {
+			inPayload = true
+			return
+		}
+		if !strings.HasPrefix(line, "-") {
+			inPayload = false
+			return
+		}
+		if !inPayload {
+			return
+		}
+		entry := strings.TrimSpace(strings.TrimPrefix(line, "-"))
+		if i := strings.Index(entry, " #"); i >= 0 {
+			entry = strings.TrimSpace(entry[:i])
+		}
+		entry = strings.Trim(entry, `'"`)
+
+		kind, value, classical := strings.Cut(entry, ",")
+		if !classical {
+			if _, ipnet, err := net.ParseCIDR(entry); err == nil {
+				l.cidrs = append(l.cidrs, ipnet)
+			} else if strings.HasPrefix(entry, "+.") || strings.HasPrefix(entry, ".") || strings.HasPrefix(entry, "*.") {
+				if !l.addDomain(strings.TrimPrefix(entry, "+")) {
+					l.warn(n, line, "not a domain")
+				}
+			} else if abpDomainRegex.MatchString(strings.ToLower(entry)) {
+				l.exact[strings.ToLower(entry)] = true
+			} else {
+				l.warn(n, line, "not a domain or CIDR")
+			}
+			return
+		}
+
+		value, _, _ = strings.Cut(value, ",") // drop options such as no-resolve
+		value = strings.ToLower(strings.TrimSpace(value))
+		switch strings.ToUpper(strings.TrimSpace(kind)) {
+		case "DOMAIN":
+			l.exact[value] = true
+		case "DOMAIN-SUFFIX":
+			if !l.addDomain(value) {
+				l.warn(n, line, "not a domain")
+			}
+		case "DOMAIN-KEYWORD":
+			l.keywords = append(l.keywords, value)
+		case "IP-CIDR", "IP-CIDR6":
+			if _, ipnet, err := net.ParseCIDR(value); err == nil {
+				l.cidrs = append(l.cidrs, ipnet)
+			} else {
+				l.warn(n, line, "invalid CIDR")
+			}
+		default:
+			l.warn(n, line, "unsupported rule type "+kind)
+		}
+	})
+	return l
+}
+
+// parseDnsmasqConf reads the domains of dnsmasq "server=/a.com/b.com/1.2.3.4",
+// "address=/…/" and "ipset=/…/" lines, as used by china-direct lists.
+func parseDnsmasqConf(content string) *domainList {
+	l := newDomainList()
+	listLines(content, func(n int, line string) {
+		_, spec, ok := strings.Cut(line, "=")
+		fields := strings.Split(spec, "/")
+		if !ok || len(fields) < 3 || fields[0] != "" {
+			l.warn(n, line, "not a dnsmasq domain directive")
+			return
+		}
+		for _, d := range fields[1 : len(fields)-1] {
+			if d != "" && !l.addDomain(d) {
+				l.warn(n, line, "not a domain: "+d)
+			}
+		}
+	})
+	return l
+}
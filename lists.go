@@ -0,0 +1,453 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ListConfig is a subscribed domain list, local or remote, in one of the list
+// formats. Rules reference it by name with the "list" type; lists that no
+// rule references are matched after all rules, sending matching traffic to
+// Outbound. Remote lists are refreshed every UpdateHours, downloading from
+// URL and then each mirror through each outbound of Via in turn.
+type ListConfig struct {
+	Name        string   `json:"name"`
+	Format      string   `json:"format"`
+	URL         string   `json:"url"`
+	Outbound    string   `json:"outbound"`
+	UpdateHours int      `json:"updateHours,omitempty"`
+	Mirrors     []string `json:"mirrors,omitempty"`
+	Via         []string `json:"via,omitempty"`
+}
+
+// defaultListUpdateHours is used when a list has no UpdateHours.
+const defaultListUpdateHours = 24
+
+// maxListSize bounds downloads so a bad mirror cannot exhaust memory.
+const maxListSize = 32 << 20
+
+// gfwListName is the name of the list migrated from the GFWList settings.
+const gfwListName = "gfwlist"
+
+// listNameRegex restricts list names, which double as cache file names.
+var listNameRegex = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// listMeta is stored next to the cached copy of a remote list so conditional
+// requests and update times survive restarts.
+type listMeta struct {
+	URL          string    `json:"url"`
+	FetchedFrom  string    `json:"fetchedFrom,omitempty"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"lastModified,omitempty"`
+	Updated      time.Time `json:"updated"`
+	Checked      time.Time `json:"checked"`
+}
+
+// ruleListState is the runtime state of one list. The matcher and warnings are
+// guarded by p.mu, and meta and lastError by mu. updateMu serializes updates;
+// it is held during downloads, so status reads only ever wait for mu.
+type ruleListState struct {
+	matcher   listMatcher
+	warnings  []string
+	updateMu  sync.Mutex
+	mu        sync.Mutex
+	meta      listMeta
+	lastError string
+}
+
+// listStatus is what /api/lists reports for each list.
+type listStatus struct {
+	Name       string    `json:"name"`
+	Format     string    `json:"format"`
+	Source     string    `json:"source"`
+	Outbound   string    `json:"outbound"`
+	Updated    time.Time `json:"updated"`
+	Checked    time.Time `json:"checked"`
+	Entries    int       `json:"entries"`
+	Exceptions int       `json:"exceptions"`
+	LastError  string    `json:"lastError"`
+	Warnings   []string  `json:"warnings"`
+}
+
+// migrateLegacyLists turns the single GFWList setting into the "gfwlist"
+// entry of cfg.Lists, routed to the gfw outbound as before.
+func migrateLegacyLists(cfg *Config) bool {
+	if cfg.Lists != nil && cfg.GFWListURL == "" {
+		return false
+	}
+	url := cfg.GFWListURL
+	if url == "" {
+		url = "gfwlist.txt"
+	}
+	gfw := ListConfig{
+		Name:        gfwListName,
+		Format:      ListFormatABP,
+		URL:         url,
+		Outbound:    OutboundGFW,
+		UpdateHours: cfg.GFWRefresh,
+		Mirrors:     cfg.GFWMirrors,
+		Via:         cfg.GFWListVia,
+	}
+	replaced := false
+	for i, l := range cfg.Lists {
+		if l.Name == gfwListName {
+			cfg.Lists[i], replaced = gfw, true
+		}
+	}
+	if !replaced {
+		cfg.Lists = append(cfg.Lists, gfw)
+	}
+	cfg.GFWListURL, cfg.GFWRefresh, cfg.GFWMirrors, cfg.GFWListVia = "", 0, nil, nil
+	return true
+}
+
+func isRemoteList(src string) bool {
+	return strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://")
+}
+
+// listConfig returns the configuration of the named list.
+func (p *ProxyServer) listConfig(name string) (ListConfig, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, l := range p.Config.Lists {
+		if l.Name == name {
+			return l, true
+		}
+	}
+	return ListConfig{}, false
+}
+
+// listState returns the runtime state of the named list, creating it and
+// restoring its saved update state on first use.
+func (p *ProxyServer) listState(name string) *ruleListState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if st, ok := p.lists[name]; ok {
+		return st
+	}
+	st := &ruleListState{}
+	if data, err := os.ReadFile(p.listMetaPath(name)); err == nil {
+		json.Unmarshal(data, &st.meta)
+	}
+	if p.lists == nil {
+		p.lists = make(map[string]*ruleListState)
+	}
+	p.lists[name] = st
+	return st
+}
+
+// listPath returns the file a list is read from: the local path for local
+// sources, relative to the config directory, or the cached copy of a remote one.
+func (p *ProxyServer) listPath(l ListConfig) string {
+	if isRemoteList(l.URL) {
+		return filepath.Join(filepath.Dir(p.configPath), l.Name+".txt")
+	}
+	path := strings.TrimPrefix(l.URL, "@")
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(filepath.Dir(p.configPath), path)
+	}
+	return path
+}
+
+func (p *ProxyServer) listMetaPath(name string) string {
+	return filepath.Join(filepath.Dir(p.configPath), name+".meta.json")
+}
+
+// loadLists loads every configured list. Lists with invalid names are skipped.
+func (p *ProxyServer) loadLists() {
+	p.mu.RLock()
+	lists := p.Config.Lists
+	p.mu.RUnlock()
+	for _, l := range lists {
+		if !listNameRegex.MatchString(l.Name) {
+			p.addLog(fmt.Sprintf("Skipping list %q: names may only contain letters, digits, '-' and '_'", l.Name))
+			continue
+		}
+		p.loadList(l.Name)
+	}
+}
+
+// loadList loads a list from its local file, or from the last good copy of
+// a remote list, downloading it first if there is none yet.
+func (p *ProxyServer) loadList(name string) error {
+	l, ok := p.listConfig(name)
+	if !ok {
+		return fmt.Errorf("unknown list %q", name)
+	}
+	path := p.listPath(l)
+	raw, err := os.ReadFile(path)
+	if err != nil && isRemoteList(l.URL) && os.IsNotExist(err) {
+		return p.updateList(name)
+	}
+	if err == nil {
+		err = p.applyList(l, raw)
+	}
+
+	st := p.listState(name)
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if err != nil {
+		st.lastError = err.Error()
+		p.addLog(fmt.Sprintf("Failed to load list %s from %s: %v", name, path, err))
+		return err
+	}
+	if !isRemoteList(l.URL) {
+		st.lastError = ""
+	}
+	return nil
+}
+
+// applyList parses list content in the list's format and makes it current.
+// A list without any entries is rejected, keeping the previous one.
+func (p *ProxyServer) applyList(l ListConfig, raw []byte) error {
+	matcher, warnings, err := parseRuleList(l.Format, raw)
+	if err != nil {
+		return err
+	}
+	entries, exceptions := matcher.Len()
+	if entries == 0 {
+		return errors.New("no entries found")
+	}
+
+	st := p.listState(l.Name)
+	p.mu.Lock()
+	st.matcher, st.warnings = matcher, warnings
+	p.mu.Unlock()
+
+	p.addLog(fmt.Sprintf("Loaded %d entries and %d exceptions from list %s", entries, exceptions, l.Name))
+	if len(warnings) > 0 {
+		p.addLog(fmt.Sprintf("List %s: %d entries skipped or partially applied (see /api/lists)", l.Name, len(warnings)))
+		for _, w := range warnings[:min(len(warnings), 5)] {
+			p.addLog("List " + l.Name + " " + w)
+		}
+	}
+	return nil
+}
+
+// updateList downloads a remote list with a conditional GET and, if it
+// changed, replaces the cached copy atomically. On failure the last good
+// copy stays in use. Local lists are simply reloaded.
+func (p *ProxyServer) updateList(name string) error {
+	l, ok := p.listConfig(name)
+	if !ok {
+		return fmt.Errorf("unknown list %q", name)
+	}
+	if !isRemoteList(l.URL) {
+		return p.loadList(name)
+	}
+
+	st := p.listState(name)
+	st.updateMu.Lock()
+	defer st.updateMu.Unlock()
+
+	// The attempt is recorded even if it fails, so the updater backs off
+	// instead of retrying a failing new URL on every tick.
+	st.mu.Lock()
+	meta := st.meta
+	st.mu.Unlock()
+	if meta.URL != l.URL {
+		meta = listMeta{URL: l.URL}
+	}
+	meta.Checked = time.Now()
+	err := p.fetchList(l, &meta)
+	if data, merr := json.MarshalIndent(meta, "", "  "); merr == nil {
+		writeFileAtomic(p.listMetaPath(name), data, 0644)
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.meta = meta
+	if err != nil {
+		st.lastError = err.Error()
+		p.addLog(fmt.Sprintf("List %s update failed, keeping the last good copy: %v", name, err))
+		return err
+	}
+	st.lastError = ""
+	return nil
+}
+
+// fetchList performs the download for updateList. The list URL and then
+// each mirror are tried through each outbound of l.Via in turn (by default
+// gfw, then default), since lists are often hosted on blocked sites. The
+// caller must hold the list state's updateMu.
+func (p *ProxyServer) fetchList(l ListConfig, meta *listMeta) error {
+	via := l.Via
+	if len(via) == 0 {
+		via = []string{OutboundGFW, OutboundDefault}
+	}
+
+	var lastErr error
+	for _, url := range append([]string{l.URL}, l.Mirrors...) {
+		for _, outbound := range via {
+			if outbound == OutboundReject || !p.outboundAvailable(outbound) {
+				continue
+			}
+			err := p.fetchListFrom(l, url, outbound, meta)
+			if err == nil {
+				return nil
+			}
+			p.addLog(fmt.Sprintf("List %s fetch from %s via %s failed: %v", l.Name, url, outbound, err))
+			lastErr = err
+		}
+	}
+	if lastErr == nil {
+		return errors.New("no usable outbound to fetch the list through")
+	}
+	return fmt.Errorf("all sources failed, last error: %w", lastErr)
+}
+
+// fetchListFrom downloads the list from url through the named outbound,
+// applying and caching it if it changed. The request is only conditional
+// while the cached copy can be read, so a 304 never leaves the list without
+// content.
+func (p *ProxyServer) fetchListFrom(l ListConfig, url, outbound string, meta *listMeta) error {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	if cached, err := os.ReadFile(p.listPath(l)); err == nil && len(cached) > 0 && meta.FetchedFrom == url {
+		if meta.ETag != "" {
+			req.Header.Set("If-None-Match", meta.ETag)
+		}
+		if meta.LastModified != "" {
+			req.Header.Set("If-Modified-Since", meta.LastModified)
+		}
+	}
+
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return p.dialOutbound(outbound, addr)
+		},
+	}
+	defer transport.CloseIdleConnections()
+	client := &http.Client{Timeout: 30 * time.Second, Transport: transport}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		p.addLog(fmt.Sprintf("List %s is up to date", l.Name))
+		return nil
+	case http.StatusOK:
+	default:
+		return fmt.Errorf("server returned %s", resp.Status)
+	}
+
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, maxListSize))
+	if err != nil {
+		return err
+	}
+	if err := p.applyList(l, raw); err != nil {
+		return fmt.Errorf("downloaded list rejected: %w", err)
+	}
+	p.addLog(fmt.Sprintf("Downloaded list %s from %s via %s", l.Name, url, outbound))
+	if err := writeFileAtomic(p.listPath(l), raw, 0644); err != nil {
+		return fmt.Errorf("saving list %s: %w", l.Name, err)
+	}
+	meta.FetchedFrom = url
+	meta.ETag = resp.Header.Get("ETag")
+	meta.LastModified = resp.Header.Get("Last-Modified")
+	meta.Updated = meta.Checked
+	return nil
+}
+
+// runListUpdater keeps remote lists fresh, each on its own schedule of
+// UpdateHours. Failed checks are retried sooner, and a slow download does
+// not hold up the other lists.
+func (p *ProxyServer) runListUpdater() {
+	for {
+		p.mu.RLock()
+		lists := p.Config.Lists
+		p.mu.RUnlock()
+
+		for _, l := range lists {
+			if !isRemoteList(l.URL) || !listNameRegex.MatchString(l.Name) {
+				continue
+			}
+			hours := l.UpdateHours
+			if hours <= 0 {
+				hours = defaultListUpdateHours
+			}
+			interval := time.Duration(hours) * time.Hour
+
+			st := p.listState(l.Name)
+			if !st.updateMu.TryLock() {
+				continue // an update is in progress
+			}
+			st.mu.Lock()
+			if st.lastError != "" {
+				interval = min(interval, 30*time.Minute)
+			}
+			due := st.meta.URL != l.URL || time.Since(st.meta.Checked) >= interval
+			st.mu.Unlock()
+			st.updateMu.Unlock()
+
+			if due {
+				go p.updateList(l.Name)
+			}
+		}
+		time.Sleep(time.Minute)
+	}
+}
+
+// listStatuses reports every configured list and the state of its updates.
+func (p *ProxyServer) listStatuses() []listStatus {
+	p.mu.RLock()
+	lists := p.Config.Lists
+	p.mu.RUnlock()
+
+	statuses := make([]listStatus, 0, len(lists))
+	for _, l := range lists {
+		statuses = append(statuses, p.listStatus(l))
+	}
+	return statuses
+}
+
+func (p *ProxyServer) listStatus(l ListConfig) listStatus {
+	st := p.listState(l.Name)
+	p.mu.RLock()
+	matcher, warnings := st.matcher, st.warnings
+	p.mu.RUnlock()
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	s := listStatus{Name: l.Name, Format: l.Format, Source: l.URL, Outbound: l.Outbound, LastError: st.lastError, Warnings: []string{}}
+	if isRemoteList(l.URL) && st.meta.URL == l.URL {
+		s.Updated, s.Checked = st.meta.Updated, st.meta.Checked
+	} else if info, err := os.Stat(p.listPath(l)); err == nil {
+		s.Updated = info.ModTime()
+	}
+	if matcher != nil {
+		s.Entries, s.Exceptions = matcher.Len()
+	}
+	if warnings != nil {
+		s.Warnings = warnings
+	}
+	return s
+}
+
+// matchList reports whether the named list covers connections to host:port.
+func (p *ProxyServer) matchList(name, host string, port int) bool {
+	p.mu.RLock()
+	st := p.lists[name]
+	var matcher listMatcher
+	if st != nil {
+		matcher = st.matcher
+	}
+	p.mu.RUnlock()
+	return matcher != nil && matcher.Match(strings.ToLower(host), port)
+}
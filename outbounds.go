@@ -0,0 +1,365 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"syscall"
+	"time"
+)
+
+// Outbound is a named egress path that rules can target. Interface outbounds
+// dial targets directly from Iface; proxy outbounds chain the connection
+// through an upstream SOCKS5 or HTTP CONNECT proxy at Server, which is itself
+// reached through Iface when one is set.
+type Outbound struct {
+	Type       string      `json:"type,omitempty"`
+	Iface      string      `json:"iface"`
+	IfaceMatch *IfaceMatch `json:"ifaceMatch,omitempty"` // used instead of Iface when set
+	SourceIP   string      `json:"sourceIp,omitempty"`
+	SourceIPv6 string      `json:"sourceIpv6,omitempty"`
+	FwMark     int         `json:"fwMark,omitempty"`
+	DNS        []string    `json:"dns,omitempty"`
+	Server     string      `json:"server,omitempty"`
+	Username   string      `json:"username,omitempty"`
+	Password   string      `json:"password,omitempty"`
+
+	// HealthCheck, when set, marks the outbound down while its probes fail.
+	HealthCheck *HealthCheck `json:"healthCheck,omitempty"`
+}
+
+// Outbound types. An empty type means OutboundInterface.
+const (
+	OutboundInterface = "interface"
+	OutboundSOCKS5    = "socks5"
+	OutboundHTTP      = "http"
+)
+
+// OutboundReject is the built-in outbound that refuses connections, for
+// rules and lists that block destinations such as ad servers.
+const OutboundReject = "reject"
+
+var errRejected = errors.New("rejected by rule")
+
+// hasIface reports whether the outbound is pinned to an interface, by name
+// or by match.
+func (o Outbound) hasIface() bool {
+	return o.Iface != "" || o.IfaceMatch != nil
+}
+
+func (o Outbound) isProxy() bool {
+	return o.Type == OutboundSOCKS5 || o.Type == OutboundHTTP
+}
+
+// migrateLegacyOutbounds turns the fixed DefaultIface/GFWIface/CompanyIface
+// fields and the per-interface Linux marks into named outbounds.
+func migrateLegacyOutbounds(cfg *Config) bool {
+	migrated := false
+	if cfg.Outbounds == nil {
+		cfg.Outbounds = map[string]Outbound{OutboundDefault: {Iface: cfg.DefaultIface}}
+		if cfg.GFWIface != "" {
+			cfg.Outbounds[OutboundGFW] = Outbound{Iface: cfg.GFWIface}
+		}
+		if cfg.CompanyIface != "" {
+			cfg.Outbounds[OutboundCompany] = Outbound{Iface: cfg.CompanyIface}
+		}
+		migrated = true
+	}
+	if len(cfg.LinuxBind.Marks) > 0 {
+		for name, ob := range cfg.Outbounds {
+			if mark, ok := cfg.LinuxBind.Marks[ob.Iface]; ok && ob.FwMark == 0 {
+				ob.FwMark = mark
+				cfg.Outbounds[name] = ob
+			}
+		}
+		cfg.LinuxBind.Marks = nil
+		migrated = true
+	}
+	cfg.DefaultIface, cfg.GFWIface, cfg.CompanyIface = "", "", ""
+	return migrated
+}
+
+// ifaceState is the index and addresses of an interface used by an outbound.
+type ifaceState struct {
+	index    int
+	ip4, ip6 string
+}
+
+// lookupOutboundIfaces resolves the interfaces used by the outbounds. It
+// returns their states by interface name and the interface each outbound
+// uses; outbounds whose interface is not available are returned with their
+// error instead.
+func lookupOutboundIfaces(outbounds map[string]Outbound) (map[string]ifaceState, map[string]string, map[string]error) {
+	states := make(map[string]ifaceState)
+	used := make(map[string]string)
+	errs := make(map[string]error)
+	var ifaces []net.Interface
+	for name, ob := range outbounds {
+		iface := ob.Iface
+		if ob.IfaceMatch != nil {
+			if ifaces == nil {
+				ifaces, _ = net.Interfaces()
+			}
+			var err error
+			if iface, err = findIface(ob.IfaceMatch, ifaces); err != nil {
+				errs[name] = err
+				continue
+			}
+		}
+		if iface == "" {
+			continue
+		}
+		idx, ip, ip6, err := getInterfaceInfo(iface)
+		if err != nil {
+			errs[name] = fmt.Errorf("interface %s not available: %w", iface, err)
+			continue
+		}
+		states[iface] = ifaceState{index: idx, ip4: ip, ip6: ip6}
+		used[name] = iface
+	}
+	return states, used, errs
+}
+
+// resolveOutbounds looks up the index and addresses of every interface used
+// by an outbound. The caller must hold p.mu.
+func (p *ProxyServer) resolveOutbounds() {
+	states, used, errs := lookupOutboundIfaces(p.Config.Outbounds)
+	for name, err := range errs {
+		p.addLog(fmt.Sprintf("Outbound %s: %v", name, err))
+	}
+	p.setInterfaces(states, used)
+}
+
+// interfaces returns the resolved interfaces and the interface each outbound
+// uses. The caller must hold p.mu.
+func (p *ProxyServer) interfaces() (map[string]ifaceState, map[string]string) {
+	states := make(map[string]ifaceState)
+	for name, idx := range p.IfaceIndices {
+		states[name] = ifaceState{index: idx, ip4: p.IfaceIPs[name], ip6: p.IfaceIPv6s[name]}
+	}
+	return states, maps.Clone(p.outboundIfaces)
+}
+
+// outboundIface returns the interface the named outbound currently uses, as
+// resolved by the interface monitor. The caller must hold p.mu.
+func (p *ProxyServer) outboundIface(name string) string {
+	if iface, ok := p.outboundIfaces[name]; ok {
+		return iface
+	}
+	ob := p.Config.Outbounds[name]
+	if ob.IfaceMatch != nil {
+		return ""
+	}
+	return ob.Iface
+}
+
+// setInterfaces replaces the resolved interfaces. Cached resolvers and idle
+// forwarded connections are dropped, as they may be bound to the old
+// addresses. The caller must hold p.mu.
+func (p *ProxyServer) setInterfaces(states map[string]ifaceState, used map[string]string) {
+	p.outboundIfaces = used
+	p.IfaceIndices = make(map[string]int)
+	p.IfaceIPs = make(map[string]string)
+	p.IfaceIPv6s = make(map[string]string)
+	for name, s := range states {
+		p.IfaceIndices[name] = s.index
+		p.IfaceIPs[name] = s.ip4
+		p.IfaceIPv6s[name] = s.ip6
+	}
+	p.resetResolvers()
+	if p.httpForwarder != nil {
+		p.httpForwarder.CloseIdleConnections()
+	}
+}
+
+// outboundAvailable reports whether rules may route to the named outbound.
+// The default and reject outbounds are always available.
+func (p *ProxyServer) outboundAvailable(name string) bool {
+	if name == OutboundDefault || name == OutboundReject {
+		return true
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	ob, ok := p.Config.Outbounds[name]
+	if ob.isProxy() {
+		return ok && ob.Server != ""
+	}
+	return ok && ob.hasIface()
+}
+
+// socketBinding identifies the interface a socket is pinned to. Each platform
+// uses the fields it supports: the index on macOS, the name or firewall mark on Linux.
+// Unavailable, when set, says why there is no interface to pin to; such
+// sockets are refused rather than sent out of the default route.
+type socketBinding struct {
+	Index       int
+	Name        string
+	Mark        int
+	Unavailable string
+}
+
+// ifaceMissing reports whether the named outbound is pinned to an interface
+// that is not available right now. The default outbound never is: without
+// its interface it uses the system's default route. The caller must hold p.mu.
+func (p *ProxyServer) ifaceMissing(name string) bool {
+	if name == OutboundDefault || !p.Config.Outbounds[name].hasIface() {
+		return false
+	}
+	_, ok := p.IfaceIndices[p.outboundIface(name)]
+	return !ok
+}
+
+// outboundLocal returns the socket binding and the IPv4/IPv6 source addresses
+// of the named outbound. Explicit source addresses override the interface's own.
+func (p *ProxyServer) outboundLocal(name string) (socketBinding, string, string) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	ob := p.Config.Outbounds[name]
+	iface := p.outboundIface(name)
+	index, ok := p.IfaceIndices[iface]
+	b := socketBinding{Index: index, Name: iface}
+	switch {
+	case p.ifaceMissing(name):
+		// Binding to index 0 would mean no binding at all on macOS.
+		if ob.IfaceMatch != nil {
+			b.Unavailable = "no interface matches " + ob.IfaceMatch.String()
+		} else {
+			b.Unavailable = "interface " + ob.Iface + " is not available"
+		}
+	case !ok:
+		b.Name = "" // the default outbound without its interface: don't pin
+	}
+	if p.Config.LinuxBind.Mode == "mark" {
+		b.Mark = ob.FwMark
+	}
+	ip4, ip6 := ob.SourceIP, ob.SourceIPv6
+	if ip4 == "" {
+		ip4 = p.IfaceIPs[iface]
+	}
+	if ip6 == "" {
+		ip6 = p.IfaceIPv6s[iface]
+	}
+	return b, ip4, ip6
+}
+
+// sourceIPFor picks the local address matching the family of dst. It reports
+// false when the interface has addresses, but none of that family.
+func sourceIPFor(dst net.IP, ip4, ip6 string) (net.IP, bool) {
+	if ip4 == "" && ip6 == "" {
+		return nil, true
+	}
+	local := ip4
+	if dst.To4() == nil {
+		local = ip6
+	}
+	if local == "" {
+		return nil, false
+	}
+	return net.ParseIP(local), true
+}
+
+// ifaceControl returns a socket Control hook that binds to the given interface.
+// A failed bind aborts the dial rather than silently using the default route.
+func ifaceControl(b socketBinding) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		if b.Unavailable != "" {
+			return errors.New(b.Unavailable)
+		}
+		var bindErr error
+		if err := c.Control(func(fd uintptr) {
+			bindErr = bindSocketToInterface(fd, network, b)
+		}); err != nil {
+			return err
+		}
+		return bindErr
+	}
+}
+
+// dialOutbound opens a TCP connection to addr through the named outbound,
+// chaining through the upstream proxy for proxy outbounds. Hostnames are
+// resolved with the outbound's DNS servers, except for proxy outbounds,
+// which pass them on to the upstream.
+func (p *ProxyServer) dialOutbound(name, addr string) (net.Conn, error) {
+	return p.dialOutboundWith(name, addr, p.resolveVia)
+}
+
+// dialOutboundWith is dialOutbound with a custom resolver for the hostnames
+// it dials itself. DNS clients use it to bootstrap their server addresses.
+func (p *ProxyServer) dialOutboundWith(name, addr string, resolve resolveFunc) (net.Conn, error) {
+	if name == OutboundReject {
+		return nil, errRejected
+	}
+	p.mu.RLock()
+	ob := p.Config.Outbounds[name]
+	p.mu.RUnlock()
+
+	if !ob.isProxy() {
+		return p.dialDirect(name, addr, resolve)
+	}
+	conn, err := p.dialDirect(name, ob.Server, resolve)
+	if err != nil {
+		return nil, fmt.Errorf("upstream %s: %w", ob.Server, err)
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	upstream := conn
+	if ob.Type == OutboundSOCKS5 {
+		err = socks5Connect(conn, ob.Username, ob.Password, addr)
+	} else {
+		upstream, err = httpConnect(conn, ob.Username, ob.Password, addr)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("upstream %s: %w", ob.Server, err)
+	}
+	conn.SetDeadline(time.Time{})
+	return upstream, nil
+}
+
+// outboundDialer returns a dialer for network ("tcp" or "udp") bound to the
+// named outbound's interface, using its source address of dst's family. It
+// reports false when the outbound has no address of that family.
+func (p *ProxyServer) outboundDialer(name, network string, dst net.IP) (*net.Dialer, bool) {
+	binding, ip4, ip6 := p.outboundLocal(name)
+	local, ok := sourceIPFor(dst, ip4, ip6)
+	if !ok {
+		return nil, false
+	}
+	var localAddr net.Addr = &net.TCPAddr{IP: local}
+	if network == "udp" {
+		localAddr = &net.UDPAddr{IP: local}
+	}
+	return &net.Dialer{
+		Timeout:   10 * time.Second,
+		LocalAddr: localAddr,
+		Control:   ifaceControl(binding),
+	}, true
+}
+
+// dialDirect opens a TCP connection to addr from the named outbound's interface.
+// Each resolved address is tried in turn, skipping families the outbound has
+// no source address for.
+func (p *ProxyServer) dialDirect(name, addr string, resolve resolveFunc) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := resolve(name, host)
+	if err != nil {
+		return nil, err
+	}
+
+	lastErr := fmt.Errorf("outbound %q has no source address for %s", name, host)
+	for _, ip := range ips {
+		dialer, ok := p.outboundDialer(name, "tcp", ip)
+		if !ok {
+			continue
+		}
+		conn, err := dialer.Dial("tcp", net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// pacHelpers are the JavaScript helpers the generated FindProxyForURL uses.
+// isInNet is only ever called on IPv4 literals, since browsers resolve
+// hostnames passed to it.
+const pacHelpers = `function isIPv4(host) {
+    return /^\d+\.\d+\.\d+\.\d+$/.test(host);
+}
+
+function isIP(host) {
+    return isIPv4(host) || host.indexOf(':') >= 0;
+}
+
+function urlPort(url) {
+    var m = /^([a-z][a-z0-9+.-]*):\/\/(?:[^@\/]*@)?(\[[^\]]*\]|[^:\/?#]*)(?::(\d+))?/i.exec(url);
+    if (!m) return 0;
+    if (m[3]) return parseInt(m[3], 10);
+    var scheme = m[1].toLowerCase();
+    return scheme === 'https' || scheme === 'wss' ? 443 : scheme === 'http' || scheme === 'ws' ? 80 : 0;
+}
+
+function inDomains(domains, host) {
+    var h = host;
+    while (true) {
+        if (domains.hasOwnProperty(h)) return true;
+        var i = h.indexOf('.');
+        if (i < 0) return false;
+        h = h.substring(i + 1);
+    }
+}
+
+function abpMatch(filters, url, host) {
+    if (inDomains(filters.domains, host)) return true;
+    for (var i = 0; i < filters.patterns.length; i++) {
+        if (filters.patterns[i].test(url)) return true;
+    }
+    return false;
+}
+
+function inList(list, url, host) {
+    if (list.block) return abpMatch(list.block, url, host) && !abpMatch(list.allow, url, host);
+    if (isIP(host)) {
+        if (!isIPv4(host)) return false;
+        for (var i = 0; i < list.cidrs.length; i++) {
+            if (isInNet(host, list.cidrs[i][0], list.cidrs[i][1])) return true;
+        }
+        return false;
+    }
+    if (list.exact.hasOwnProperty(host) || inDomains(list.suffixes, host)) return true;
+    for (var j = 0; j < list.keywords.length; j++) {
+        if (host.indexOf(list.keywords[j]) >= 0) return true;
+    }
+    return false;
+}
+`
+
+// unportableRegex matches RE2 syntax that JavaScript regular expressions do
+// not understand, such as inline flags, named groups and POSIX classes.
+var unportableRegex = regexp.MustCompile(`\(\?[^:]|\\[zApPQE]|\[\[:`)
+
+// generatePAC compiles the routing rules into a proxy auto-config script.
+// Traffic for the default outbound goes DIRECT; everything else is sent to
+// the proxy port, which then applies the full rules. Rules that cannot be
+// expressed in a PAC script hand all remaining traffic to the proxy, so the
+// browser never bypasses a routing decision.
+func (p *ProxyServer) generatePAC() string {
+	p.mu.RLock()
+	rules := p.rules
+	port := p.Config.Port
+	defaultIsProxy := p.Config.Outbounds[OutboundDefault].isProxy()
+	lists := make(map[string]listMatcher)
+	for _, r := range rules {
+		if r.Type == RuleList {
+			name := strings.TrimSpace(r.Value)
+			if st := p.lists[name]; st != nil {
+				lists[name] = st.matcher
+			} else {
+				lists[name] = nil
+			}
+		}
+	}
+	p.mu.RUnlock()
+
+	action := func(outbound string) string {
+		if outbound == OutboundDefault && !defaultIsProxy {
+			return pacString("DIRECT")
+		}
+		return "proxy"
+	}
+
+	var b strings.Builder
+	b.WriteString("// Generated by SmartProxy from the current routing rules.\n\n")
+	b.WriteString(pacHelpers)
+	proxy := fmt.Sprintf("SOCKS5 127.0.0.1:%d; SOCKS 127.0.0.1:%d; PROXY 127.0.0.1:%d", port, port, port)
+	fmt.Fprintf(&b, "\nvar proxy = %s;\n", pacString(proxy))
+	names := make([]string, 0, len(lists))
+	for name := range lists {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	b.WriteString("var lists = {")
+	for i, name := range names {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		fmt.Fprintf(&b, "\n%s: %s", pacString(name), pacList(lists[name]))
+	}
+	b.WriteString("\n};\n\n")
+	b.WriteString("function FindProxyForURL(url, host) {\n")
+	b.WriteString("    host = host.toLowerCase().replace(/\\.$/, '');\n")
+	b.WriteString("    var port = urlPort(url);\n")
+	for _, r := range rules {
+		if !p.outboundAvailable(r.Outbound) {
+			continue
+		}
+		cond, ok := pacCondition(r.Rule)
+		if !ok {
+			fmt.Fprintf(&b, "    // %s %s cannot be expressed in PAC; the proxy decides from here on.\n", r.Type, pacComment(r.Value))
+			b.WriteString("    return proxy;\n}\n")
+			return b.String()
+		}
+		if r.Type == RuleList {
+			if l, ok := lists[strings.TrimSpace(r.Value)].(*domainList); ok && pacHasIPv6(l.cidrs) {
+				fmt.Fprintf(&b, "    if (host.indexOf(':') >= 0) return proxy; // list %s has IPv6 networks\n", pacComment(r.Value))
+			}
+		}
+		fmt.Fprintf(&b, "    if (%s) return %s; // %s %s -> %s\n", cond, action(r.Outbound), r.Type, pacComment(r.Value), r.Outbound)
+	}
+	fmt.Fprintf(&b, "    return %s;\n", action(OutboundDefault))
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// pacCondition returns the JavaScript expression matching r, mirroring
+// compileRule. It reports false for rules with no PAC equivalent.
+func pacCondition(r Rule) (string, bool) {
+	value := strings.TrimSpace(r.Value)
+	lower := strings.ToLower(value)
+
+	switch r.Type {
+	case RuleDomain:
+		return "host === " + pacString(lower), true
+	case RuleDomainSuffix:
+		lower = strings.TrimPrefix(lower, ".")
+		return fmt.Sprintf("host === %s || dnsDomainIs(host, %s)", pacString(lower), pacString("."+lower)), true
+	case RuleDomainKeyword:
+		return fmt.Sprintf("!isIP(host) && host.indexOf(%s) >= 0", pacString(lower)), true
+	case RuleRegex:
+		if unportableRegex.MatchString(value) {
+			return "", false
+		}
+		return fmt.Sprintf("new RegExp(%s).test(host)", pacString(value)), true
+	case RuleCIDR:
+		_, ipnet, err := net.ParseCIDR(value)
+		if err != nil {
+			return "", false
+		}
+		if ipnet.IP.To4() == nil {
+			ones, _ := ipnet.Mask.Size()
+			if ones != 0 {
+				return "", false
+			}
+			return "host.indexOf(':') >= 0", true
+		}
+		return fmt.Sprintf("isIPv4(host) && isInNet(host, %s, %s)",
+			pacString(ipnet.IP.String()), pacString(net.IP(ipnet.Mask).String())), true
+	case RulePort:
+		lo, hi, err := parsePortRange(value)
+		if err != nil {
+			return "", false
+		}
+		return fmt.Sprintf("port >= %d && port <= %d", lo, hi), true
+	case RuleList:
+		return fmt.Sprintf("inList(lists[%s], url, host)", pacString(value)), true
+	}
+	return "", false
+}
+
+// pacList renders a compiled list for inList. Lists that are not loaded
+// render as an empty filter list.
+func pacList(m listMatcher) string {
+	if l, ok := m.(*domainList); ok {
+		return pacDomainList(l)
+	}
+	l, _ := m.(*abpList)
+	if l == nil {
+		l = &abpList{}
+	}
+	return fmt.Sprintf("{\n    block: %s,\n    allow: %s\n}", pacABPFilters(l.block), pacABPFilters(l.allow))
+}
+
+// pacDomainList renders a domain list. Only IPv4 networks are rendered, as
+// isInNet does not take IPv6 ones.
+func pacDomainList(l *domainList) string {
+	keywords := make([]string, len(l.keywords))
+	for i, k := range l.keywords {
+		keywords[i] = pacString(k)
+	}
+	var cidrs []string
+	for _, n := range l.cidrs {
+		if n.IP.To4() != nil {
+			cidrs = append(cidrs, "["+pacString(n.IP.String())+", "+pacString(net.IP(n.Mask).String())+"]")
+		}
+	}
+	return fmt.Sprintf("{\n    suffixes: %s,\n    exact: %s,\n    keywords: [%s],\n    cidrs: [%s]\n}",
+		pacObject(l.suffixes), pacObject(l.exact), strings.Join(keywords, ", "), strings.Join(cidrs, ", "))
+}
+
+func pacHasIPv6(cidrs []*net.IPNet) bool {
+	for _, n := range cidrs {
+		if n.IP.To4() == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func pacABPFilters(f abpFilters) string {
+	patterns := make([]string, len(f.patterns))
+	for i, p := range f.patterns {
+		patterns[i] = "new RegExp(" + pacString(p.source) + ", 'i')"
+	}
+	return fmt.Sprintf("{domains: %s, patterns: [%s]}", pacObject(f.domains), strings.Join(patterns, ", "))
+}
+
+// pacObject renders a set as a JavaScript object literal.
+func pacObject(set map[string]bool) string {
+	if set == nil {
+		return "{}"
+	}
+	b, _ := json.Marshal(set)
+	return string(b)
+}
+
+func pacString(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+// pacComment makes s safe to place in a // comment.
+func pacComment(s string) string {
+	return strings.NewReplacer("\n", " ", "\r", " ").Replace(s)
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"net"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Profile is a named set of outbounds and rules, such as "home" or "office".
+// The active profile's outbounds and rules are the top-level Outbounds and
+// Rules of the config, which is what the proxy and the web UI work with;
+// the copy in Profiles is refreshed from them whenever the config is saved.
+type Profile struct {
+	Outbounds map[string]Outbound `json:"outbounds"`
+	Rules     []Rule              `json:"rules"`
+	Match     *ProfileMatch       `json:"match,omitempty"`
+}
+
+// ProfileMatch describes the network a profile is meant for. With
+// Config.AutoProfile set, a profile is activated when all of its non-empty
+// conditions hold.
+type ProfileMatch struct {
+	Gateway string `json:"gateway,omitempty"` // IPv4 default gateway
+	Iface   string `json:"iface,omitempty"`   // interface that is present and up
+	Subnet  string `json:"subnet,omitempty"`  // CIDR holding an IPv4 address of the default interface
+	Probe   string `json:"probe,omitempty"`   // host:port that accepts TCP connections
+}
+
+// syncActiveProfile stores the top-level outbounds and rules into the active
+// profile. It replaces cfg.Profiles rather than writing to a map that may be
+// shared with the running config.
+func syncActiveProfile(cfg *Config) {
+	if cfg.ActiveProfile == "" {
+		return
+	}
+	if _, ok := cfg.Profiles[cfg.ActiveProfile]; !ok {
+		return
+	}
+	cfg.Profiles = maps.Clone(cfg.Profiles)
+	prof := cfg.Profiles[cfg.ActiveProfile]
+	prof.Outbounds = maps.Clone(cfg.Outbounds)
+	prof.Rules = slices.Clone(cfg.Rules)
+	cfg.Profiles[cfg.ActiveProfile] = prof
+}
+
+// selectProfile makes the named profile the active one in cfg, keeping the
+// current outbounds and rules in the profile that was active.
+func selectProfile(cfg *Config, name string) error {
+	prof, ok := cfg.Profiles[name]
+	if !ok {
+		return fmt.Errorf("unknown profile %q", name)
+	}
+	cfg.Profiles = maps.Clone(cfg.Profiles)
+	syncActiveProfile(cfg)
+	cfg.Outbounds = maps.Clone(prof.Outbounds)
+	cfg.Rules = slices.Clone(prof.Rules)
+	cfg.ActiveProfile = name
+	return nil
+}
+
+// profileNames returns the configured profiles in name order and the active one.
+func profileNames(cfg *Config) ([]string, string) {
+	names := make([]string, 0, len(cfg.Profiles))
+	for name := range cfg.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, cfg.ActiveProfile
+}
+
+// switchProfile activates a profile through the same path as a saved config,
+// so listeners and connections are kept. Interfaces the profile names that
+// are missing, such as a VPN that is not connected yet, are only logged.
+func (p *ProxyServer) switchProfile(name string) error {
+	p.configMu.Lock()
+	defer p.configMu.Unlock()
+	p.mu.RLock()
+	cfg := p.Config
+	p.mu.RUnlock()
+
+	if cfg.ActiveProfile == name {
+		return nil
+	}
+	if err := selectProfile(&cfg, name); err != nil {
+		return err
+	}
+	// normalizeConfig writes to the lists, which cfg still shares with the
+	// running config; selectProfile already copied the rest it touches.
+	cfg.Lists = slices.Clone(cfg.Lists)
+	normalizeConfig(&cfg)
+	if errs := validateConfigStructure(&cfg); len(errs) > 0 {
+		return fmt.Errorf("profile %s is invalid: %s: %s", name, errs[0].Field, errs[0].Message)
+	}
+	for _, e := range missingInterfaces(&cfg) {
+		p.addLog(fmt.Sprintf("Profile %s: %s: %s", name, e.Field, e.Message))
+	}
+	if err := p.applyConfig(cfg); err != nil {
+		return err
+	}
+	p.addLog(fmt.Sprintf("Switched to profile %s", name))
+	return p.saveConfig()
+}
+
+// profileSelectInterval is how often profile conditions are checked without
+// an interface change.
+const profileSelectInterval = 10 * time.Second
+
+// waitNetworkChange waits for the interface monitor to report a change, or
+// for the timeout.
+func (p *ProxyServer) waitNetworkChange(timeout time.Duration) {
+	select {
+	case <-p.networkChanged:
+	case <-time.After(timeout):
+	}
+}
+
+// networkFacts is the state of the network that profile conditions are
+// checked against.
+type networkFacts struct {
+	gateway      net.IP
+	defaultIface string                  // interface of the default route
+	up           map[string]bool         // interfaces that are up
+	addrs        map[string][]*net.IPNet // IPv4 addresses of the interfaces that are up
+}
+
+func gatherNetworkFacts() networkFacts {
+	f := networkFacts{up: make(map[string]bool), addrs: make(map[string][]*net.IPNet)}
+	f.gateway, f.defaultIface, _ = defaultGateway()
+	ifaces, _ := net.Interfaces()
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		f.up[iface.Name] = true
+		addrs, _ := iface.Addrs()
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+				f.addrs[iface.Name] = append(f.addrs[iface.Name], ipnet)
+			}
+		}
+	}
+	return f
+}
+
+// String summarizes the facts for the log; a different summary means the
+// network changed.
+func (f networkFacts) String() string {
+	names := make([]string, 0, len(f.up))
+	for name := range f.up {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	fmt.Fprintf(&b, "gateway %v via %s, interfaces", f.gateway, f.defaultIface)
+	for _, name := range names {
+		fmt.Fprintf(&b, " %s%v", name, f.addrs[name])
+	}
+	return b.String()
+}
+
+// matches reports whether all conditions of m hold. iface is the interface
+// whose subnet is checked. The probe is only dialed when the other conditions
+// hold. A match without conditions never holds.
+func (m *ProfileMatch) matches(f networkFacts, iface string) bool {
+	if m == nil || *m == (ProfileMatch{}) {
+		return false
+	}
+	if m.Gateway != "" && !f.gateway.Equal(net.ParseIP(m.Gateway)) {
+		return false
+	}
+	if m.Iface != "" && !f.up[m.Iface] {
+		return false
+	}
+	if m.Subnet != "" {
+		_, subnet, err := net.ParseCIDR(m.Subnet)
+		if err != nil || !slices.ContainsFunc(f.addrs[iface], func(n *net.IPNet) bool { return subnet.Contains(n.IP) }) {
+			return false
+		}
+	}
+	if m.Probe != "" {
+		conn, err := net.DialTimeout("tcp", m.Probe, 3*time.Second)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+	}
+	return true
+}
+
+// profileConditions is what automatic profile selection depends on, copied
+// out of the config so probes can run without holding p.mu.
+type profileConditions struct {
+	auto    bool
+	active  string
+	iface   string // the default outbound's interface, if set
+	names   []string
+	matches []ProfileMatch
+}
+
+func (p *ProxyServer) profileConditions() profileConditions {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	c := profileConditions{auto: p.Config.AutoProfile, iface: p.outboundIface(OutboundDefault)}
+	c.names, c.active = profileNames(&p.Config)
+	for _, name := range c.names {
+		var m ProfileMatch
+		if pm := p.Config.Profiles[name].Match; pm != nil {
+			m = *pm
+		}
+		c.matches = append(c.matches, m)
+	}
+	return c
+}
+
+// selectProfileFor returns the first profile, in name order, whose
+// conditions hold, or "" if there is none. Subnets are checked on the default
+// outbound's interface, or on the default route's when it has none.
+func (c profileConditions) selectProfileFor(f networkFacts) string {
+	iface := c.iface
+	if iface == "" {
+		iface = f.defaultIface
+	}
+	for i, name := range c.names {
+		if c.matches[i].matches(f, iface) {
+			return name
+		}
+	}
+	return ""
+}
+
+// runProfileSelector switches to the matching profile whenever the network
+// or the profile conditions change while Config.AutoProfile is set. It wakes
+// up on interface monitor events, and periodically to notice config changes.
+// When no profile matches, the active one is kept. A manual switch stays in
+// effect until the next change.
+func (p *ProxyServer) runProfileSelector() {
+	last := ""
+	for ; ; p.waitNetworkChange(profileSelectInterval) {
+		c := p.profileConditions()
+		if !c.auto {
+			last = ""
+			continue
+		}
+		f := gatherNetworkFacts()
+		key := f.String() + fmt.Sprint(c.iface, c.names, c.matches)
+		if key == last {
+			continue
+		}
+		last = key
+		name := c.selectProfileFor(f)
+		if name == "" || name == c.active {
+			continue
+		}
+		p.addLog(fmt.Sprintf("Network matches profile %s (%s)", name, f))
+		if err := p.switchProfile(name); err != nil {
+			p.addLog(fmt.Sprintf("Failed to switch to profile %s: %v", name, err))
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+)
+
+// configChanges is what applyConfig has to redo for a new config.
+type configChanges struct {
+	listeners bool     // proxy ports or IPv6 listening changed
+	dnsServer bool     // local DNS server settings changed
+	changed   []string // names of the changed sections, for the log
+	reload    []string // lists that are new or have a new format or local path
+	refetch   []string // remote lists with a new URL
+	removed   []string // lists that are no longer configured
+}
+
+// diffConfig compares the running config with cfg.
+func diffConfig(old, cfg *Config) configChanges {
+	var c configChanges
+	c.listeners = old.Port != cfg.Port || old.HTTPPort != cfg.HTTPPort || old.ListenIPv6 != cfg.ListenIPv6
+	c.dnsServer = old.DNSServer != cfg.DNSServer
+
+	sections := []struct {
+		name    string
+		changed bool
+	}{
+		{"listeners", c.listeners},
+		{"DNS server", c.dnsServer},
+		{"outbounds", !reflect.DeepEqual(old.Outbounds, cfg.Outbounds) || old.LinuxBind.Mode != cfg.LinuxBind.Mode},
+		{"rules", !reflect.DeepEqual(old.Rules, cfg.Rules)},
+		{"lists", !reflect.DeepEqual(old.Lists, cfg.Lists)},
+		{"users", !reflect.DeepEqual(old.Auth, cfg.Auth)},
+		{"profile", old.ActiveProfile != cfg.ActiveProfile},
+	}
+	for _, s := range sections {
+		if s.changed {
+			c.changed = append(c.changed, s.name)
+		}
+	}
+
+	oldLists := make(map[string]ListConfig)
+	for _, l := range old.Lists {
+		oldLists[l.Name] = l
+	}
+	for _, l := range cfg.Lists {
+		prev, ok := oldLists[l.Name]
+		delete(oldLists, l.Name)
+		switch {
+		case ok && prev.URL != l.URL && isRemoteList(l.URL):
+			c.refetch = append(c.refetch, l.Name)
+		case !ok || prev.URL != l.URL || prev.Format != l.Format:
+			c.reload = append(c.reload, l.Name)
+		}
+	}
+	for name := range oldLists {
+		c.removed = append(c.removed, name)
+	}
+	return c
+}
+
+// applyConfig makes cfg the running configuration without a restart.
+// Interfaces are re-resolved and rules recompiled; listeners are rebound
+// only when the ports change, and lists are reloaded only when their source
+// or format changes. Established connections keep running. If the new ports
+// cannot be bound, the old listeners are restored and nothing is applied.
+func (p *ProxyServer) applyConfig(cfg Config) error {
+	p.mu.Lock()
+	changes := diffConfig(&p.Config, &cfg)
+
+	var socksListeners, httpListeners []net.Listener
+	if p.running && changes.listeners {
+		closeListeners(p.listeners)
+		p.listeners = nil
+		var err error
+		socksListeners, httpListeners, err = openListeners(&cfg)
+		if err != nil {
+			oldSocks, oldHTTP, rerr := openListeners(&p.Config)
+			if rerr != nil {
+				p.addLog(fmt.Sprintf("Failed to restore the proxy listeners: %v", rerr))
+			}
+			p.listeners = append(oldSocks, oldHTTP...)
+			p.mu.Unlock()
+			p.serveListeners(oldSocks, oldHTTP)
+			return fmt.Errorf("cannot listen on the new proxy ports: %w", err)
+		}
+		p.listeners = append(socksListeners, httpListeners...)
+	}
+
+	p.Config = cfg
+	p.resolveOutbounds()
+	profiles, active := profileNames(&p.Config)
+	restartDNS := p.running && changes.dnsServer
+	if restartDNS {
+		p.stopDNSServer()
+	}
+	for _, name := range changes.removed {
+		delete(p.lists, name)
+	}
+	p.mu.Unlock()
+
+	p.compileRules()
+	p.serveListeners(socksListeners, httpListeners)
+	if restartDNS {
+		p.startConfiguredDNSServer(cfg.DNSServer)
+	}
+	if len(changes.reload)+len(changes.refetch) > 0 {
+		go func() {
+			for _, name := range changes.reload {
+				p.loadList(name)
+			}
+			for _, name := range changes.refetch {
+				p.updateList(name)
+			}
+		}()
+	}
+
+	if len(changes.changed) == 0 {
+		p.addLog("Configuration applied (no changes)")
+	} else {
+		p.addLog("Configuration applied (changed: " + strings.Join(changes.changed, ", ") + ")")
+	}
+	if p.onProfileChange != nil {
+		p.onProfileChange(profiles, active)
+	}
+	return nil
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Rule maps a matcher to a named outbound. Rules are evaluated in order and
+// the first match wins; traffic matching no rule uses the default outbound.
+// List rules without an outbound use the list's own.
+// DNS servers set on a rule resolve the hosts it matches instead of the
+// outbound's own servers, so e.g. internal names can use a company resolver.
+// While the outbound is down, because its interface is missing or it fails
+// its health check, the Fallback outbound, if set, is used instead.
+type Rule struct {
+	Type     string   `json:"type"`
+	Value    string   `json:"value"`
+	Outbound string   `json:"outbound"`
+	DNS      []string `json:"dns,omitempty"`
+	Fallback string   `json:"fallback,omitempty"`
+}
+
+// Rule types.
+const (
+	RuleDomain        = "domain"
+	RuleDomainSuffix  = "domain-suffix"
+	RuleDomainKeyword = "domain-keyword"
+	RuleRegex         = "regex"
+	RuleCIDR          = "cidr"
+	RulePort          = "port"
+	RuleList          = "list"
+)
+
+func knownRuleType(t string) bool {
+	switch t {
+	case RuleDomain, RuleDomainSuffix, RuleDomainKeyword, RuleRegex, RuleCIDR, RulePort, RuleList:
+		return true
+	}
+	return false
+}
+
+// Outbound names created when migrating the legacy interface fields.
+const (
+	OutboundDefault = "default"
+	OutboundGFW     = "gfw"
+	OutboundCompany = "company"
+)
+
+type compiledRule struct {
+	Rule
+	match func(host string, ip net.IP, port int) bool
+}
+
+// compileRule turns a Rule into its matcher. Values are case-insensitive
+// except for regex rules.
+func (p *ProxyServer) compileRule(r Rule) (compiledRule, error) {
+	value := strings.TrimSpace(r.Value)
+	lower := strings.ToLower(value)
+	cr := compiledRule{Rule: r}
+
+	switch r.Type {
+	case RuleDomain:
+		cr.match = func(host string, ip net.IP, port int) bool {
+			return host == lower
+		}
+	case RuleDomainSuffix:
+		lower = strings.TrimPrefix(lower, ".")
+		cr.match = func(host string, ip net.IP, port int) bool {
+			return host == lower || strings.HasSuffix(host, "."+lower)
+		}
+	case RuleDomainKeyword:
+		cr.match = func(host string, ip net.IP, port int) bool {
+			return ip == nil && strings.Contains(host, lower)
+		}
+	case RuleRegex:
+		re, err := regexp.Compile(value)
+		if err != nil {
+			return cr, err
+		}
+		cr.match = func(host string, ip net.IP, port int) bool {
+			return re.MatchString(host)
+		}
+	case RuleCIDR:
+		_, ipnet, err := net.ParseCIDR(value)
+		if err != nil {
+			return cr, err
+		}
+		cr.match = func(host string, ip net.IP, port int) bool {
+			return ip != nil && ipnet.Contains(ip)
+		}
+	case RulePort:
+		lo, hi, err := parsePortRange(value)
+		if err != nil {
+			return cr, err
+		}
+		cr.match = func(host string, ip net.IP, port int) bool {
+			return port >= lo && port <= hi
+		}
+	case RuleList:
+		l, ok := p.listConfig(value)
+		if !ok {
+			return cr, fmt.Errorf("unknown list %q", value)
+		}
+		if cr.Outbound == "" {
+			cr.Outbound = l.Outbound
+		}
+		cr.match = func(host string, ip net.IP, port int) bool {
+			return p.matchList(l.Name, host, port)
+		}
+	default:
+		return cr, fmt.Errorf("unknown rule type %q", r.Type)
+	}
+	return cr, nil
+}
+
+// parsePortRange parses "443" or "8000-9000".
+func parsePortRange(s string) (int, int, error) {
+	loStr, hiStr, isRange := strings.Cut(s, "-")
+	lo, err := strconv.Atoi(strings.TrimSpace(loStr))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port %q", s)
+	}
+	hi := lo
+	if isRange {
+		if hi, err = strconv.Atoi(strings.TrimSpace(hiStr)); err != nil {
+			return 0, 0, fmt.Errorf("invalid port range %q", s)
+		}
+	}
+	if lo < 0 || hi > 65535 || lo > hi {
+		return 0, 0, fmt.Errorf("invalid port range %q", s)
+	}
+	return lo, hi, nil
+}
+
+// compileRules rebuilds the rule matchers from the current config. Invalid
+// rules are logged and skipped. Lists that no rule references follow the
+// rules, in the order they are configured.
+func (p *ProxyServer) compileRules() {
+	p.mu.RLock()
+	rules := p.Config.Rules
+	lists := p.Config.Lists
+	p.mu.RUnlock()
+
+	compiled := make([]compiledRule, 0, len(rules)+len(lists))
+	referenced := make(map[string]bool)
+	for i, r := range rules {
+		cr, err := p.compileRule(r)
+		if err != nil {
+			p.addLog(fmt.Sprintf("Skipping rule #%d (%s %s): %v", i+1, r.Type, r.Value, err))
+			continue
+		}
+		if r.Type == RuleList {
+			referenced[strings.TrimSpace(r.Value)] = true
+		}
+		compiled = append(compiled, cr)
+	}
+	for _, l := range lists {
+		if referenced[l.Name] || !listNameRegex.MatchString(l.Name) {
+			continue
+		}
+		cr, err := p.compileRule(Rule{Type: RuleList, Value: l.Name})
+		if err != nil {
+			continue
+		}
+		compiled = append(compiled, cr)
+	}
+
+	p.mu.Lock()
+	p.rules = compiled
+	p.mu.Unlock()
+}
+
+// route is the outcome of rule matching: the outbound to use and the DNS
+// servers of the matching rule, if it has any.
+type route struct {
+	Outbound string
+	DNS      []string
+}
+
+// resolver returns the resolveFunc for connections following rt.
+func (rt route) resolver(p *ProxyServer) resolveFunc {
+	return func(outbound, host string) ([]net.IP, error) {
+		return p.resolveWith(outbound, rt.DNS, host)
+	}
+}
+
+// selectRoute returns the route for host:port. Rules that target an
+// undefined or unconfigured outbound are skipped, and rules whose outbound
+// is down use their fallback, with the fallback's own DNS servers.
+func (p *ProxyServer) selectRoute(host string, port int) route {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	ip := net.ParseIP(host)
+
+	p.mu.RLock()
+	rules := p.rules
+	p.mu.RUnlock()
+
+	for _, r := range rules {
+		if !r.match(host, ip, port) || !p.outboundAvailable(r.Outbound) {
+			continue
+		}
+		if r.Fallback != "" && !p.outboundUp(r.Outbound) && p.outboundAvailable(r.Fallback) && p.outboundUp(r.Fallback) {
+			return route{Outbound: r.Fallback}
+		}
+		return route{Outbound: r.Outbound, DNS: r.DNS}
+	}
+	return route{Outbound: OutboundDefault}
+}
+
+// migrateLegacyRules folds the old BypassDomains/CompanyDomains/ExtraGFWDomains
+// buckets into cfg.Rules, preserving their precedence. A config without any
+// rules gets the chain the fixed routing used to implement: IP literals and
+// bypass domains go direct, then company domains, extra GFW domains and the GFWList.
+func migrateLegacyRules(cfg *Config) bool {
+	if cfg.Rules != nil && len(cfg.BypassDomains)+len(cfg.CompanyDomains)+len(cfg.ExtraGFWDomains) == 0 {
+		return false
+	}
+
+	var legacy []Rule
+	if cfg.Rules == nil {
+		legacy = append(legacy,
+			Rule{Type: RuleCIDR, Value: "0.0.0.0/0", Outbound: OutboundDefault},
+			Rule{Type: RuleCIDR, Value: "::/0", Outbound: OutboundDefault},
+		)
+	}
+	for _, d := range cfg.BypassDomains {
+		legacy = append(legacy, Rule{Type: RuleDomainSuffix, Value: d, Outbound: OutboundDefault})
+	}
+	for _, d := range cfg.CompanyDomains {
+		legacy = append(legacy, Rule{Type: RuleDomainSuffix, Value: d, Outbound: OutboundCompany})
+	}
+	for _, d := range cfg.ExtraGFWDomains {
+		legacy = append(legacy, Rule{Type: RuleDomainSuffix, Value: d, Outbound: OutboundGFW})
+	}
+	if cfg.Rules == nil {
+		legacy = append(legacy, Rule{Type: RuleList, Value: gfwListName, Outbound: OutboundGFW})
+	}
+
+	cfg.Rules = append(legacy, cfg.Rules...)
+	cfg.BypassDomains = nil
+	cfg.CompanyDomains = nil
+	cfg.ExtraGFWDomains = nil
+	return true
+}
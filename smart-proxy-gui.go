@@ -2,8 +2,10 @@ package main
 
 import (
 	"bufio"
-	"encoding/base64"
+	"bytes"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -13,11 +15,10 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
-	"regexp"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
-	"syscall"
 	"time"
 
 	"github.com/getlantern/systray"
@@ -25,29 +26,103 @@ import (
 
 // Config represents the proxy configuration
 type Config struct {
-	Port            int      `json:"port"`
-	DefaultIface    string   `json:"defaultIface"`
-	GFWIface        string   `json:"gfwIface"`
-	CompanyIface    string   `json:"companyIface"`
-	GFWListURL      string   `json:"gfwlistUrl"`
-	CompanyDomains  []string `json:"companyDomains"`
-	BypassDomains   []string `json:"bypassDomains"`
-	ExtraGFWDomains []string `json:"extraGfwDomains"`
-	AutoStart       bool     `json:"autoStart"`
+	Port       int                 `json:"port"`
+	HTTPPort   int                 `json:"httpPort"`
+	Outbounds  map[string]Outbound `json:"outbounds"`
+	Lists      []ListConfig        `json:"lists"`
+	Rules      []Rule              `json:"rules"`
+	AutoStart  bool                `json:"autoStart"`
+	ListenIPv6 bool                `json:"listenIPv6"`
+	Auth       AuthConfig          `json:"auth"`
+	LinuxBind  LinuxBindConfig     `json:"linuxBind"`
+	DNSServer  DNSServerConfig     `json:"dnsServer"`
+
+	// Profiles are named alternative sets of outbounds and rules; see Profile.
+	Profiles      map[string]Profile `json:"profiles,omitempty"`
+	ActiveProfile string             `json:"activeProfile,omitempty"`
+	AutoProfile   bool               `json:"autoProfile,omitempty"`
+
+	// NotifyInterfaceChanges shows interface changes in the tray tooltip.
+	NotifyInterfaceChanges bool `json:"notifyInterfaceChanges,omitempty"`
+
+	// Deprecated: legacy fixed interfaces, migrated into Outbounds on load.
+	DefaultIface string `json:"defaultIface,omitempty"`
+	GFWIface     string `json:"gfwIface,omitempty"`
+	CompanyIface string `json:"companyIface,omitempty"`
+
+	// Deprecated: legacy routing buckets, migrated into Rules on load.
+	CompanyDomains  []string `json:"companyDomains,omitempty"`
+	BypassDomains   []string `json:"bypassDomains,omitempty"`
+	ExtraGFWDomains []string `json:"extraGfwDomains,omitempty"`
+
+	// Deprecated: the single GFWList source, migrated into Lists on load.
+	GFWListURL string   `json:"gfwlistUrl,omitempty"`
+	GFWRefresh int      `json:"gfwlistUpdateHours,omitempty"`
+	GFWMirrors []string `json:"gfwlistMirrors,omitempty"`
+	GFWListVia []string `json:"gfwlistVia,omitempty"`
 }
 
+// LinuxBindConfig selects how sockets are pinned to interfaces on Linux:
+// "device" (SO_BINDTODEVICE, the default) or "mark" (SO_MARK with each
+// outbound's FwMark, for setups routed by `ip rule`).
+type LinuxBindConfig struct {
+	Mode string `json:"mode"`
+
+	// Deprecated: per-interface marks, migrated into Outbound.FwMark on load.
+	Marks map[string]int `json:"marks,omitempty"`
+}
+
+// AuthConfig holds the SOCKS5 username/password credentials (RFC 1929).
+// Authentication is required as soon as at least one user is configured.
+type AuthConfig struct {
+	Users []AuthUser `json:"users"`
+}
+
+type AuthUser struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+const (
+	socksMethodNoAuth       = 0x00
+	socksMethodUserPass     = 0x02
+	socksMethodNoAcceptable = 0xFF
+)
+
 type ProxyServer struct {
-	Config       Config
-	GFWDomains   map[string]bool
-	IfaceIndices map[string]int
-	IfaceIPs     map[string]string
-	listener     net.Listener
-	running      bool
-	mu           sync.RWMutex
-	logBuffer    []string
-	logMu        sync.Mutex
-	configPath   string
-	onStatusChange func(running bool)
+	Config          Config
+	lists           map[string]*ruleListState
+	rules           []compiledRule
+	dnsCache        dnsCache
+	dohMu           sync.Mutex
+	dohClients      map[string]*http.Client
+	dnsResponses    dnsResponseCache
+	dnsPacketConn   net.PacketConn
+	dnsListener     net.Listener
+	httpForwarder   *http.Transport
+	IfaceIndices    map[string]int
+	IfaceIPs        map[string]string
+	IfaceIPv6s      map[string]string
+	outboundIfaces  map[string]string
+	health          map[string]*outboundHealth
+	healthMu        sync.Mutex
+	listeners       []net.Listener
+	running         bool
+	mu              sync.RWMutex
+	logBuffer       []string
+	logMu           sync.Mutex
+	configPath      string
+	saveMu          sync.Mutex
+	onStatusChange  func(running bool)
+	onProfileChange func(profiles []string, active string)
+	// onInterfaceChange is called with a summary when outbound interfaces
+	// change and NotifyInterfaceChanges is set.
+	onInterfaceChange func(summary string)
+	// configMu serializes config changes from the web UI, backup restores
+	// and profile switches, so none of them overwrites another's.
+	configMu sync.Mutex
+	// networkChanged is signalled by the interface monitor.
+	networkChanged chan struct{}
 }
 
 func (p *ProxyServer) addLog(msg string) {
@@ -61,12 +136,20 @@ func (p *ProxyServer) addLog(msg string) {
 	log.Println(msg)
 }
 
+// saveConfig writes the running config to disk. The write is atomic, and the
+// version it replaces is kept as a backup.
 func (p *ProxyServer) saveConfig() error {
-	data, err := json.MarshalIndent(p.Config, "", "  ")
+	p.saveMu.Lock()
+	defer p.saveMu.Unlock()
+	p.mu.RLock()
+	cfg := p.Config
+	syncActiveProfile(&cfg)
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	p.mu.RUnlock()
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(p.configPath, data, 0644)
+	return p.writeConfig(data)
 }
 
 func (p *ProxyServer) loadConfig() error {
@@ -74,152 +157,52 @@ func (p *ProxyServer) loadConfig() error {
 	if err != nil {
 		return err
 	}
-	return json.Unmarshal(data, &p.Config)
+	if err := json.Unmarshal(data, &p.Config); err != nil {
+		return err
+	}
+	if migrateConfig(&p.Config) {
+		p.addLog("Migrated legacy interface, domain and GFWList settings into outbounds, rules and lists")
+		if err := p.saveConfig(); err != nil {
+			p.addLog(fmt.Sprintf("Failed to save migrated config: %v", err))
+		}
+	}
+	return nil
 }
 
-func getInterfaceInfo(ifaceName string) (int, string, error) {
+// migrateConfig upgrades legacy fields in cfg and reports whether anything changed.
+func migrateConfig(cfg *Config) bool {
+	rules := migrateLegacyRules(cfg)
+	outbounds := migrateLegacyOutbounds(cfg)
+	lists := migrateLegacyLists(cfg)
+	return rules || outbounds || lists
+}
+
+// getInterfaceInfo returns the index of the interface together with its first
+// IPv4 address and first global IPv6 address (either may be empty).
+func getInterfaceInfo(ifaceName string) (int, string, string, error) {
 	iface, err := net.InterfaceByName(ifaceName)
 	if err != nil {
-		return 0, "", err
+		return 0, "", "", err
 	}
 	addrs, err := iface.Addrs()
 	if err != nil {
-		return iface.Index, "", nil
+		return iface.Index, "", "", nil
 	}
+	var ip4, ip6 string
 	for _, addr := range addrs {
-		if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
-			if ipnet.IP.To4() != nil {
-				return iface.Index, ipnet.IP.String(), nil
-			}
-		}
-	}
-	return iface.Index, "", nil
-}
-
-func (p *ProxyServer) loadGFWList() error {
-	p.mu.RLock()
-	url := p.Config.GFWListURL
-	p.mu.RUnlock()
-
-	var raw []byte
-	var err error
-
-	if strings.HasPrefix(url, "@") || (!strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://")) {
-		path := strings.TrimPrefix(url, "@")
-		if !filepath.IsAbs(path) {
-			path = filepath.Join(filepath.Dir(p.configPath), path)
-		}
-		raw, err = os.ReadFile(path)
-		if err != nil {
-			return err
-		}
-	} else {
-		resp, err := http.Get(url)
-		if err != nil {
-			return err
-		}
-		defer resp.Body.Close()
-		raw, err = io.ReadAll(resp.Body)
-		if err != nil {
-			return err
-		}
-	}
-
-	decoded, err := base64.StdEncoding.DecodeString(string(raw))
-	content := ""
-	if err == nil {
-		content = string(decoded)
-	} else {
-		content = string(raw)
-	}
-
-	p.mu.Lock()
-	p.GFWDomains = make(map[string]bool)
-	domainRegex := regexp.MustCompile(`([A-Za-z0-9.-]+\.[A-Za-z]{2,})$`)
-	scanner := bufio.NewScanner(strings.NewReader(content))
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line == "" || strings.HasPrefix(line, "!") || strings.HasPrefix(line, "[") || strings.HasPrefix(line, "@@") {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.IsLoopback() {
 			continue
 		}
-		line = strings.TrimLeft(line, "|.")
-		for _, sep := range []string{"/", "^", "*", "?"} {
-			if idx := strings.Index(line, sep); idx != -1 {
-				line = line[:idx]
+		if ipnet.IP.To4() != nil {
+			if ip4 == "" {
+				ip4 = ipnet.IP.String()
 			}
+		} else if ip6 == "" && ipnet.IP.IsGlobalUnicast() {
+			ip6 = ipnet.IP.String()
 		}
-		line = strings.Trim(line, ".")
-		match := domainRegex.FindStringSubmatch(line)
-		if len(match) > 1 {
-			p.GFWDomains[strings.ToLower(match[1])] = true
-		}
-	}
-	p.mu.Unlock()
-
-	p.addLog(fmt.Sprintf("Loaded %d domains from GFWList", len(p.GFWDomains)))
-	return nil
-}
-
-func (p *ProxyServer) isGFWDomain(host string) bool {
-	host = strings.ToLower(host)
-	p.mu.RLock()
-	defer p.mu.RUnlock()
-	if p.GFWDomains[host] {
-		return true
-	}
-	for _, domain := range p.Config.ExtraGFWDomains {
-		if host == domain || strings.HasSuffix(host, "."+domain) {
-			return true
-		}
-	}
-	parts := strings.Split(host, ".")
-	for i := 0; i < len(parts)-1; i++ {
-		suffix := strings.Join(parts[i:], ".")
-		if p.GFWDomains[suffix] {
-			return true
-		}
-	}
-	return false
-}
-
-func (p *ProxyServer) isBypassDomain(host string) bool {
-	host = strings.ToLower(host)
-	p.mu.RLock()
-	defer p.mu.RUnlock()
-	for _, domain := range p.Config.BypassDomains {
-		if host == domain || strings.HasSuffix(host, "."+domain) {
-			return true
-		}
-	}
-	return false
-}
-
-func (p *ProxyServer) isCompanyDomain(host string) bool {
-	host = strings.ToLower(host)
-	p.mu.RLock()
-	defer p.mu.RUnlock()
-	for _, domain := range p.Config.CompanyDomains {
-		if host == domain || strings.HasSuffix(host, "."+domain) {
-			return true
-		}
-	}
-	return false
-}
-
-func (p *ProxyServer) selectIface(host string) string {
-	if net.ParseIP(host) != nil {
-		return p.Config.DefaultIface
-	}
-	if p.isBypassDomain(host) {
-		return p.Config.DefaultIface
 	}
-	if p.isCompanyDomain(host) && p.Config.CompanyIface != "" {
-		return p.Config.CompanyIface
-	}
-	if p.isGFWDomain(host) {
-		return p.Config.GFWIface
-	}
-	return p.Config.DefaultIface
+	return iface.Index, ip4, ip6, nil
 }
 
 func (p *ProxyServer) AutoDetectGFWIface() string {
@@ -235,20 +218,19 @@ func (p *ProxyServer) AutoDetectGFWIface() string {
 			continue
 		}
 
-		idx, ip, err := getInterfaceInfo(iface.Name)
-		if err != nil || ip == "" {
+		idx, ip, ip6, err := getInterfaceInfo(iface.Name)
+		if err != nil || (ip == "" && ip6 == "") {
 			continue
 		}
+		if ip == "" {
+			ip = ip6
+		}
 
 		p.addLog(fmt.Sprintf("Testing interface %s (%s)...", iface.Name, ip))
 
 		dialer := &net.Dialer{
 			Timeout: 3 * time.Second,
-			Control: func(network, address string, c syscall.RawConn) error {
-				return c.Control(func(fd uintptr) {
-					bindSocketToInterface(fd, network, idx)
-				})
-			},
+			Control: ifaceControl(socketBinding{Index: idx, Name: iface.Name}),
 		}
 
 		conn, err := dialer.Dial("tcp", "www.google.com:80")
@@ -264,15 +246,22 @@ func (p *ProxyServer) AutoDetectGFWIface() string {
 	return ""
 }
 
-func (p *ProxyServer) AutoDetectCompanyIface() string {
+// AutoDetectOutboundIface finds an interface that can reach the first domain
+// routed to the named outbound by a domain or domain-suffix rule.
+func (p *ProxyServer) AutoDetectOutboundIface(name string) string {
+	targetDomain := ""
 	p.mu.RLock()
-	if len(p.Config.CompanyDomains) == 0 {
-		p.mu.RUnlock()
-		p.addLog("No Company Domains configured, cannot detect Company Interface")
-		return ""
+	for _, r := range p.Config.Rules {
+		if r.Outbound == name && (r.Type == RuleDomain || r.Type == RuleDomainSuffix) {
+			targetDomain = strings.TrimPrefix(r.Value, ".")
+			break
+		}
 	}
-	targetDomain := p.Config.CompanyDomains[0]
 	p.mu.RUnlock()
+	if targetDomain == "" {
+		p.addLog(fmt.Sprintf("No domain rules target outbound %s, cannot detect its interface", name))
+		return ""
+	}
 
 	ifaces, err := net.Interfaces()
 	if err != nil {
@@ -285,39 +274,38 @@ func (p *ProxyServer) AutoDetectCompanyIface() string {
 			continue
 		}
 
-		idx, ip, err := getInterfaceInfo(iface.Name)
-		if err != nil || ip == "" {
+		idx, ip, ip6, err := getInterfaceInfo(iface.Name)
+		if err != nil || (ip == "" && ip6 == "") {
 			continue
 		}
+		if ip == "" {
+			ip = ip6
+		}
 
-		p.addLog(fmt.Sprintf("Testing interface %s (%s) for company domain %s...", iface.Name, ip, targetDomain))
+		p.addLog(fmt.Sprintf("Testing interface %s (%s) for %s domain %s...", iface.Name, ip, name, targetDomain))
 
 		dialer := &net.Dialer{
 			Timeout: 3 * time.Second,
-			Control: func(network, address string, c syscall.RawConn) error {
-				return c.Control(func(fd uintptr) {
-					bindSocketToInterface(fd, network, idx)
-				})
-			},
+			Control: ifaceControl(socketBinding{Index: idx, Name: iface.Name}),
 		}
 
 		conn, err := dialer.Dial("tcp", net.JoinHostPort(targetDomain, "80"))
 		if err == nil {
 			conn.Close()
-			p.addLog(fmt.Sprintf("Interface %s is working for Company VPN", iface.Name))
+			p.addLog(fmt.Sprintf("Interface %s is working for outbound %s", iface.Name, name))
 			return iface.Name
 		}
 		// Also try 443
 		conn, err = dialer.Dial("tcp", net.JoinHostPort(targetDomain, "443"))
 		if err == nil {
 			conn.Close()
-			p.addLog(fmt.Sprintf("Interface %s is working for Company VPN", iface.Name))
+			p.addLog(fmt.Sprintf("Interface %s is working for outbound %s", iface.Name, name))
 			return iface.Name
 		}
 		p.addLog(fmt.Sprintf("Interface %s failed for %s: %v", iface.Name, targetDomain, err))
 	}
 
-	p.addLog(fmt.Sprintf("No interface can reach %s, setting Company Interface to None", targetDomain))
+	p.addLog(fmt.Sprintf("No interface can reach %s, setting %s interface to None", targetDomain, name))
 	return ""
 }
 
@@ -328,45 +316,104 @@ func (p *ProxyServer) Start() error {
 		return fmt.Errorf("server already running")
 	}
 
-	p.IfaceIndices = make(map[string]int)
-	p.IfaceIPs = make(map[string]string)
-	for _, name := range []string{p.Config.DefaultIface, p.Config.GFWIface, p.Config.CompanyIface} {
-		if name == "" {
-			continue
-		}
-		idx, ip, err := getInterfaceInfo(name)
-		if err == nil {
-			p.IfaceIndices[name] = idx
-			p.IfaceIPs[name] = ip
-		}
-	}
+	p.resolveOutbounds()
 
-	ln, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", p.Config.Port))
+	socksListeners, httpListeners, err := openListeners(&p.Config)
 	if err != nil {
 		p.mu.Unlock()
 		return err
 	}
-	p.listener = ln
+	p.listeners = append(socksListeners, httpListeners...)
 	p.running = true
+	dnsServer := p.Config.DNSServer
 	p.mu.Unlock()
 
 	if p.onStatusChange != nil {
 		p.onStatusChange(true)
 	}
 
-	p.loadGFWList()
-	p.addLog(fmt.Sprintf("SOCKS5 Proxy started on 127.0.0.1:%d", p.Config.Port))
+	p.loadLists()
+	p.serveListeners(socksListeners, httpListeners)
+	p.startConfiguredDNSServer(dnsServer)
+	return nil
+}
 
-	go func() {
-		for {
-			conn, err := ln.Accept()
-			if err != nil {
-				return
-			}
-			go p.handleConnection(conn)
+// openListeners listens on the main proxy port and, if set, the dedicated
+// HTTP proxy port of cfg.
+func openListeners(cfg *Config) ([]net.Listener, []net.Listener, error) {
+	socksListeners, err := listenLoopback(cfg.Port, cfg.ListenIPv6)
+	if err != nil {
+		return nil, nil, err
+	}
+	var httpListeners []net.Listener
+	if cfg.HTTPPort != 0 {
+		httpListeners, err = listenLoopback(cfg.HTTPPort, cfg.ListenIPv6)
+		if err != nil {
+			closeListeners(socksListeners)
+			return nil, nil, err
 		}
-	}()
-	return nil
+	}
+	return socksListeners, httpListeners, nil
+}
+
+// serveListeners starts accepting connections on listeners from openListeners.
+func (p *ProxyServer) serveListeners(socksListeners, httpListeners []net.Listener) {
+	for _, ln := range socksListeners {
+		p.addLog(fmt.Sprintf("SOCKS5/SOCKS4/HTTP Proxy started on %s", ln.Addr()))
+		go p.serve(ln, p.handleConnection)
+	}
+	for _, ln := range httpListeners {
+		p.addLog(fmt.Sprintf("HTTP Proxy started on %s", ln.Addr()))
+		go p.serve(ln, p.handleHTTPConnection)
+	}
+}
+
+// startConfiguredDNSServer starts the local DNS server if cfg enables it.
+func (p *ProxyServer) startConfiguredDNSServer(cfg DNSServerConfig) {
+	if !cfg.Enabled {
+		return
+	}
+	addr := cfg.Listen
+	if addr == "" {
+		addr = defaultDNSListen
+	}
+	if err := p.startDNSServer(addr); err != nil {
+		p.addLog(fmt.Sprintf("DNS server failed to start on %s: %v", addr, err))
+	}
+}
+
+// listenLoopback listens on 127.0.0.1:port and, if v6 is set, on [::1]:port.
+func listenLoopback(port int, v6 bool) ([]net.Listener, error) {
+	addrs := []string{fmt.Sprintf("127.0.0.1:%d", port)}
+	if v6 {
+		addrs = append(addrs, fmt.Sprintf("[::1]:%d", port))
+	}
+	var listeners []net.Listener
+	for _, addr := range addrs {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			closeListeners(listeners)
+			return nil, err
+		}
+		listeners = append(listeners, ln)
+	}
+	return listeners, nil
+}
+
+func closeListeners(listeners []net.Listener) {
+	for _, ln := range listeners {
+		ln.Close()
+	}
+}
+
+func (p *ProxyServer) serve(ln net.Listener, handle func(net.Conn)) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go handle(conn)
+	}
 }
 
 func (p *ProxyServer) IsRunning() bool {
@@ -378,10 +425,9 @@ func (p *ProxyServer) IsRunning() bool {
 func (p *ProxyServer) Stop() {
 	p.mu.Lock()
 	defer p.mu.Unlock()
-	if p.listener != nil {
-		p.listener.Close()
-		p.listener = nil
-	}
+	closeListeners(p.listeners)
+	p.listeners = nil
+	p.stopDNSServer()
 	p.running = false
 	if p.onStatusChange != nil {
 		p.onStatusChange(false)
@@ -389,7 +435,88 @@ func (p *ProxyServer) Stop() {
 	p.addLog("Proxy server stopped")
 }
 
+// negotiateAuth picks a method the client offered and, for username/password,
+// runs the RFC 1929 sub-negotiation. It returns false if the connection must be closed.
+func (p *ProxyServer) negotiateAuth(client net.Conn, methods []byte) bool {
+	p.mu.RLock()
+	users := p.Config.Auth.Users
+	p.mu.RUnlock()
+
+	want := byte(socksMethodNoAuth)
+	if len(users) > 0 {
+		want = socksMethodUserPass
+	}
+	if bytes.IndexByte(methods, want) == -1 {
+		client.Write([]byte{0x05, socksMethodNoAcceptable})
+		return false
+	}
+	client.Write([]byte{0x05, want})
+	if want == socksMethodNoAuth {
+		return true
+	}
+
+	buf := make([]byte, 256)
+	if _, err := io.ReadFull(client, buf[:2]); err != nil || buf[0] != 0x01 {
+		return false
+	}
+	ulen := int(buf[1])
+	if _, err := io.ReadFull(client, buf[:ulen]); err != nil {
+		return false
+	}
+	username := string(buf[:ulen])
+	if _, err := io.ReadFull(client, buf[:1]); err != nil {
+		return false
+	}
+	plen := int(buf[0])
+	if _, err := io.ReadFull(client, buf[:plen]); err != nil {
+		return false
+	}
+	password := string(buf[:plen])
+
+	if checkCredentials(users, username, password) {
+		client.Write([]byte{0x01, 0x00})
+		return true
+	}
+	client.Write([]byte{0x01, 0x01})
+	p.addLog(fmt.Sprintf("SOCKS5 authentication failed for user %q from %s", username, client.RemoteAddr()))
+	return false
+}
+
+// checkCredentials reports whether username/password match one of users,
+// comparing in constant time.
+func checkCredentials(users []AuthUser, username, password string) bool {
+	for _, u := range users {
+		userOK := subtle.ConstantTimeCompare([]byte(u.Username), []byte(username)) == 1
+		passOK := subtle.ConstantTimeCompare([]byte(u.Password), []byte(password)) == 1
+		if userOK && passOK {
+			return true
+		}
+	}
+	return false
+}
+
+// handleConnection serves a connection on the main port, which speaks
+// SOCKS5, SOCKS4/4a and HTTP proxy. The protocol is told apart by the first
+// byte: the SOCKS version number, or the start of an HTTP method.
 func (p *ProxyServer) handleConnection(client net.Conn) {
+	br := bufio.NewReader(client)
+	first, err := br.Peek(1)
+	if err != nil {
+		client.Close()
+		return
+	}
+	conn := &bufferedConn{Conn: client, r: br}
+	switch first[0] {
+	case 0x05:
+		p.handleSOCKS5(conn)
+	case 0x04:
+		p.handleSOCKS4(conn)
+	default:
+		p.handleHTTPConnection(conn)
+	}
+}
+
+func (p *ProxyServer) handleSOCKS5(client net.Conn) {
 	defer client.Close()
 	buf := make([]byte, 256)
 	if _, err := io.ReadFull(client, buf[:2]); err != nil || buf[0] != 0x05 {
@@ -399,71 +526,76 @@ func (p *ProxyServer) handleConnection(client net.Conn) {
 	if _, err := io.ReadFull(client, buf[:nmethods]); err != nil {
 		return
 	}
-	client.Write([]byte{0x05, 0x00})
-	if _, err := io.ReadFull(client, buf[:4]); err != nil || buf[0] != 0x05 {
+	if !p.negotiateAuth(client, buf[:nmethods]) {
 		return
 	}
-	var host string
-	switch buf[3] {
-	case 0x01:
-		if _, err := io.ReadFull(client, buf[:4]); err != nil {
-			return
-		}
-		host = net.IP(buf[:4]).String()
-	case 0x03:
-		if _, err := io.ReadFull(client, buf[:1]); err != nil {
-			return
-		}
-		l := int(buf[0])
-		if _, err := io.ReadFull(client, buf[:l]); err != nil {
-			return
-		}
-		host = string(buf[:l])
-	default:
+	if _, err := io.ReadFull(client, buf[:3]); err != nil || buf[0] != 0x05 {
 		return
 	}
-	if _, err := io.ReadFull(client, buf[:2]); err != nil {
+	cmd := buf[1]
+	host, port, err := readSocksAddr(client)
+	if err != nil {
+		if err == errUnsupportedAddrType {
+			writeSocksReply(client, socksRepAddrNotSupported, nil)
+		}
 		return
 	}
-	port := int(buf[0])<<8 | int(buf[1])
-	targetAddr := net.JoinHostPort(host, fmt.Sprintf("%d", port))
 
-	targetIface := p.selectIface(host)
-	p.mu.RLock()
-	ifIndex := p.IfaceIndices[targetIface]
-	localIP := p.IfaceIPs[targetIface]
-	p.mu.RUnlock()
-
-	dialer := &net.Dialer{
-		LocalAddr: &net.TCPAddr{IP: net.ParseIP(localIP)},
-		Control: func(network, address string, c syscall.RawConn) error {
-			return c.Control(func(fd uintptr) {
-				bindSocketToInterface(fd, network, ifIndex)
-			})
-		},
+	switch cmd {
+	case socksCmdConnect:
+		p.handleConnect(client, host, port)
+	case socksCmdUDPAssociate:
+		p.handleUDPAssociate(client)
+	default:
+		writeSocksReply(client, socksRepCmdNotSupported, nil)
 	}
+}
 
-	remote, err := dialer.Dial("tcp", targetAddr)
-	if err != nil {
-		client.Write([]byte{0x05, 0x05, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+func (p *ProxyServer) handleConnect(client net.Conn, host string, port int) {
+	remote, err := p.dialRoute(host, port)
+	if errors.Is(err, errRejected) {
+		writeSocksReply(client, socksRepNotAllowed, nil)
+		return
+	} else if err != nil {
+		writeSocksReply(client, socksRepConnRefused, nil)
 		return
 	}
 	defer remote.Close()
-	client.Write([]byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+	writeSocksReply(client, socksRepSucceeded, nil)
+	relay(client, remote)
+}
+
+// dialRoute connects to host:port through the outbound the rules select for
+// it. Failures are logged.
+func (p *ProxyServer) dialRoute(host string, port int) (net.Conn, error) {
+	targetAddr := net.JoinHostPort(host, strconv.Itoa(port))
+	rt := p.selectRoute(host, port)
+	remote, err := p.dialOutboundWith(rt.Outbound, targetAddr, rt.resolver(p))
+	if errors.Is(err, errRejected) {
+		p.addLog(fmt.Sprintf("Rejected %s", targetAddr))
+	} else if err != nil {
+		p.addLog(fmt.Sprintf("Connect to %s via %s failed: %v", targetAddr, rt.Outbound, err))
+	}
+	return remote, err
+}
+
+// relay copies data both ways until each side has finished sending,
+// propagating half-closes so request/response protocols see EOF.
+func relay(client, remote net.Conn) {
 	var wg sync.WaitGroup
 	wg.Add(2)
 	go func() {
 		defer wg.Done()
 		io.Copy(remote, client)
-		if tcp, ok := remote.(*net.TCPConn); ok {
-			tcp.CloseWrite()
+		if cw, ok := remote.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
 		}
 	}()
 	go func() {
 		defer wg.Done()
 		io.Copy(client, remote)
-		if tcp, ok := client.(*net.TCPConn); ok {
-			tcp.CloseWrite()
+		if cw, ok := client.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
 		}
 	}()
 	wg.Wait()
@@ -517,16 +649,22 @@ func main() {
 	}
 
 	p := &ProxyServer{
-		configPath: *configPath,
+		configPath:     *configPath,
+		networkChanged: make(chan struct{}, 1),
 		Config: Config{
-			Port:         1080,
-			DefaultIface: "en0",
-			GFWListURL:   filepath.Join(configDir, "gfwlist.txt"),
-			AutoStart:    true,
+			Port:      1080,
+			Outbounds: map[string]Outbound{OutboundDefault: {Iface: "en0"}},
+			Lists: []ListConfig{{
+				Name:     gfwListName,
+				Format:   ListFormatABP,
+				URL:      "https://raw.githubusercontent.com/gfwlist/gfwlist/master/gfwlist.txt",
+				Outbound: OutboundGFW,
+			}},
+			AutoStart: true,
 		},
 	}
 
-	// Ensure gfwlist.txt exists in configDir
+	// Ensure gfwlist.txt exists in configDir; it seeds the cache of the remote list.
 	gfwDest := filepath.Join(configDir, "gfwlist.txt")
 	if _, err := os.Stat(gfwDest); os.IsNotExist(err) {
 		// Try to find it in the same directory as the executable or Resources
@@ -544,7 +682,19 @@ func main() {
 		}
 	}
 
-	if err := p.loadConfig(); err == nil {
+	err = p.loadConfig()
+	if err != nil {
+		migrateConfig(&p.Config)
+	}
+	p.compileRules()
+	p.mu.Lock()
+	p.resolveOutbounds()
+	p.mu.Unlock()
+	go p.runListUpdater()
+	go p.runInterfaceMonitor()
+	go p.runHealthChecker()
+	go p.runProfileSelector()
+	if err == nil {
 		log.Printf("[*] Loaded config from %s", *configPath)
 		if p.Config.AutoStart {
 			go p.Start()
@@ -566,16 +716,33 @@ func main() {
 	http.HandleFunc("/api/config", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == "POST" {
 			var cfg Config
-			json.NewDecoder(r.Body).Decode(&cfg)
-			p.mu.Lock()
-			p.Config = cfg
-			p.mu.Unlock()
-			p.saveConfig()
+			if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+				writeFieldErrors(w, []fieldError{{Message: "invalid JSON: " + err.Error()}})
+				return
+			}
+			migrateConfig(&cfg)
+			normalizeConfig(&cfg)
+			if errs := validateConfig(&cfg); len(errs) > 0 {
+				writeFieldErrors(w, errs)
+				return
+			}
+			p.configMu.Lock()
+			defer p.configMu.Unlock()
+			if err := p.applyConfig(cfg); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if err := p.saveConfig(); err != nil {
+				http.Error(w, "applied but not saved: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
 			w.WriteHeader(http.StatusOK)
 			return
 		}
 		p.mu.RLock()
-		json.NewEncoder(w).Encode(p.Config)
+		cfg := p.Config
+		syncActiveProfile(&cfg)
+		json.NewEncoder(w).Encode(cfg)
 		p.mu.RUnlock()
 	})
 
@@ -591,6 +758,94 @@ func main() {
 		p.mu.RUnlock()
 	})
 
+	http.HandleFunc("/api/lists", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(p.listStatuses())
+	})
+
+	http.HandleFunc("/api/lists/update", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		l, ok := p.listConfig(r.URL.Query().Get("name"))
+		if !ok {
+			http.Error(w, "unknown list", http.StatusNotFound)
+			return
+		}
+		p.updateList(l.Name)
+		json.NewEncoder(w).Encode(p.listStatus(l))
+	})
+
+	http.HandleFunc("/api/backups", func(w http.ResponseWriter, r *http.Request) {
+		backups, err := p.listConfigBackups()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(backups)
+	})
+
+	http.HandleFunc("/api/backups/diff", func(w http.ResponseWriter, r *http.Request) {
+		diff, err := p.diffConfigBackup(r.URL.Query().Get("id"))
+		if errors.Is(err, os.ErrNotExist) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"diff": diff})
+	})
+
+	http.HandleFunc("/api/backups/restore", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var invalid fieldErrors
+		if err := p.restoreConfigBackup(r.URL.Query().Get("id")); errors.Is(err, os.ErrNotExist) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		} else if errors.As(err, &invalid) {
+			writeFieldErrors(w, invalid)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	http.HandleFunc("/api/health", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(p.healthStatuses())
+	})
+
+	http.HandleFunc("/api/network", func(w http.ResponseWriter, r *http.Request) {
+		f := gatherNetworkFacts()
+		var subnet string
+		if addrs := f.addrs[f.defaultIface]; len(addrs) > 0 {
+			subnet = (&net.IPNet{IP: addrs[0].IP.Mask(addrs[0].Mask), Mask: addrs[0].Mask}).String()
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"gateway":      f.gateway,
+			"defaultIface": f.defaultIface,
+			"subnet":       subnet,
+			"profile":      p.profileConditions().selectProfileFor(f),
+		})
+	})
+
+	http.HandleFunc("/api/profiles/switch", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := p.switchProfile(r.URL.Query().Get("name")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
 	http.HandleFunc("/api/start", func(w http.ResponseWriter, r *http.Request) {
 		if err := p.Start(); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -604,22 +859,43 @@ func main() {
 		w.WriteHeader(http.StatusOK)
 	})
 
-	http.HandleFunc("/api/autodetect-gfw", func(w http.ResponseWriter, r *http.Request) {
-		iface := p.AutoDetectGFWIface()
+	http.HandleFunc("/api/autodetect", func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Query().Get("outbound")
+		if name == "" {
+			http.Error(w, "missing outbound", http.StatusBadRequest)
+			return
+		}
+		var iface string
+		if name == OutboundGFW {
+			iface = p.AutoDetectGFWIface()
+		} else {
+			iface = p.AutoDetectOutboundIface(name)
+		}
+		p.configMu.Lock()
+		defer p.configMu.Unlock()
 		p.mu.Lock()
-		p.Config.GFWIface = iface
+		if p.Config.Outbounds == nil {
+			p.Config.Outbounds = make(map[string]Outbound)
+		}
+		ob := p.Config.Outbounds[name]
+		ob.Iface = iface
+		ob.IfaceMatch = nil
+		p.Config.Outbounds[name] = ob
+		if p.running {
+			p.resolveOutbounds()
+		}
 		p.mu.Unlock()
-		p.saveConfig()
+		if err := p.saveConfig(); err != nil {
+			http.Error(w, "applied but not saved: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
 		json.NewEncoder(w).Encode(map[string]string{"iface": iface})
 	})
 
-	http.HandleFunc("/api/autodetect-company", func(w http.ResponseWriter, r *http.Request) {
-		iface := p.AutoDetectCompanyIface()
-		p.mu.Lock()
-		p.Config.CompanyIface = iface
-		p.mu.Unlock()
-		p.saveConfig()
-		json.NewEncoder(w).Encode(map[string]string{"iface": iface})
+	http.HandleFunc("/proxy.pac", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+		w.Header().Set("Cache-Control", "no-cache")
+		fmt.Fprint(w, p.generatePAC())
 	})
 
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
@@ -638,6 +914,9 @@ func main() {
         #log { background: #1e1e1e; color: #00ff00; height: 500px; overflow-y: scroll; font-family: monospace; padding: 10px; font-size: 12px; }
         .status-on { color: #28a745; font-weight: bold; }
         .status-off { color: #dc3545; font-weight: bold; }
+        #backupDiff { max-height: 400px; overflow: auto; font-size: 12px; }
+        #backupDiff .add { color: #198754; }
+        #backupDiff .del { color: #dc3545; }
     </style>
 </head>
 <body>
@@ -650,6 +929,12 @@ func main() {
                     <button id="btnStop" class="btn btn-sm btn-outline-danger" onclick="control('stop')" title="Stop"><i class="bi bi-stop-fill"></i></button>
                     <button class="btn btn-sm btn-outline-secondary" onclick="saveConfig()" title="Save"><i class="bi bi-save"></i></button>
                 </div>
+                <div class="input-group input-group-sm w-auto">
+                    <span class="input-group-text">Profile</span>
+                    <select id="profileSelect" class="form-select form-select-sm" data-field="activeProfile" onchange="switchProfile(this.value)"></select>
+                    <button class="btn btn-outline-secondary" type="button" onclick="newProfile()" title="New profile from the current outbounds and rules"><i class="bi bi-plus"></i></button>
+                    <button id="btnDeleteProfile" class="btn btn-outline-danger" type="button" onclick="deleteProfile()" title="Delete this profile"><i class="bi bi-trash"></i></button>
+                </div>
             </div>
             <div id="statusBadge"></div>
         </div>
@@ -659,36 +944,87 @@ func main() {
                 <div class="card">
                     <div class="card-header fw-bold">General Settings</div>
                     <div class="card-body">
-                        <div class="mb-3"><label class="form-label">SOCKS5 Port</label><input type="number" id="proxyPort" class="form-control"></div>
-                        <div class="mb-3"><label class="form-label">Default Interface</label><select id="defaultIface" class="form-select"></select></div>
+                        <div class="row mb-3">
+                            <div class="col"><label class="form-label">Proxy Port <small class="text-muted">(SOCKS5/4/HTTP)</small></label><input type="number" id="proxyPort" class="form-control" data-field="port"></div>
+                            <div class="col"><label class="form-label">HTTP Proxy Port</label><input type="number" id="httpPort" class="form-control" placeholder="disabled" data-field="httpPort"></div>
+                        </div>
+                        <div class="form-text mb-3">Browsers can use the auto-config script at <a id="pacUrl" href="/proxy.pac" target="_blank"></a>, which sends default-outbound traffic direct.</div>
                         <div class="mb-3">
-                            <label class="form-label">GFW Interface (Personal VPN)</label>
-                            <div class="input-group">
-                                <select id="gfwIface" class="form-select"></select>
-                                <button class="btn btn-outline-secondary" type="button" onclick="autoDetectGFW()" title="Auto Detect"><i class="bi bi-search"></i> Detect</button>
-                            </div>
+                            <label class="form-label">SOCKS5 Users</label>
+                            <textarea id="authUsers" data-field="auth.users" class="form-control font-monospace" rows="2" placeholder="user:password (one per line, empty = no authentication)"></textarea>
                         </div>
                         <div class="mb-3">
-                            <label class="form-label">Company Interface (Company VPN)</label>
-                            <div class="input-group">
-                                <select id="companyIface" class="form-select"></select>
-                                <button class="btn btn-outline-secondary" type="button" onclick="autoDetectCompany()" title="Auto Detect"><i class="bi bi-search"></i> Detect</button>
+                            <label class="form-label">Linux Interface Binding</label>
+                            <select id="linuxBindMode" class="form-select" data-field="linuxBind.mode">
+                                <option value="device">SO_BINDTODEVICE (bind to device)</option>
+                                <option value="mark">SO_MARK (firewall mark for ip rule)</option>
+                            </select>
+                        </div>
+                        <div class="mb-3">
+                            <div class="form-check form-switch">
+                                <input class="form-check-input" type="checkbox" id="dnsServerEnabled">
+                                <label class="form-check-label" for="dnsServerEnabled">Local DNS server (resolves names through the rules)</label>
                             </div>
+                            <input id="dnsServerListen" data-field="dnsServer.listen" class="form-control mt-2" placeholder="127.0.0.1:5353">
                         </div>
                     </div>
                 </div>
+
+                <div class="card">
+                    <div class="card-header fw-bold d-flex justify-content-between align-items-center">
+                        Outbounds
+                        <button class="btn btn-sm btn-outline-primary" type="button" onclick="addOutbound()"><i class="bi bi-plus"></i> Add</button>
+                    </div>
+                    <div class="card-body" id="outboundsBody"></div>
+                </div>
                 
+                <div class="card">
+                    <div class="card-header fw-bold d-flex justify-content-between align-items-center">
+                        Rule Lists
+                        <button class="btn btn-sm btn-outline-primary" type="button" onclick="addList()"><i class="bi bi-plus"></i> Add</button>
+                    </div>
+                    <div class="card-body" id="listsBody"></div>
+                </div>
+
                 <div class="card">
                     <div class="card-header fw-bold">Rules & Settings</div>
                     <div class="card-body">
-                        <div class="mb-3"><label class="form-label">Company Domains</label><textarea id="companyDomains" class="form-control" rows="2" placeholder="e.g. company.com, internal.net"></textarea></div>
-                        <div class="mb-3"><label class="form-label">Bypass Domains (Direct)</label><textarea id="bypassDomains" class="form-control" rows="2" placeholder="e.g. example.com, local.dev"></textarea></div>
-                        <div class="mb-3"><label class="form-label">Extra GFW Domains</label><textarea id="extraGfwDomains" class="form-control" rows="2" placeholder="e.g. gvt2.com, google.com"></textarea></div>
-                        <div class="mb-3"><label class="form-label">GFWList URL/Path</label><input id="gfwlistUrl" class="form-control"></div>
+                        <div class="mb-3">
+                            <label class="form-label">Routing Rules <small class="text-muted">(first match wins, unmatched traffic uses default)</small></label>
+                            <table class="table table-sm align-middle mb-2">
+                                <thead><tr><th style="width: 18%">Type</th><th>Value</th><th style="width: 15%">Outbound</th><th style="width: 15%">Fallback</th><th style="width: 20%">DNS <small class="text-muted">(optional)</small></th><th style="width: 90px"></th></tr></thead>
+                                <tbody id="rulesBody"></tbody>
+                            </table>
+                            <button class="btn btn-sm btn-outline-primary" type="button" onclick="addRule()"><i class="bi bi-plus"></i> Add Rule</button>
+                        </div>
                         <div class="form-check form-switch mt-3">
                             <input class="form-check-input" type="checkbox" id="autoStart">
                             <label class="form-check-label" for="autoStart">Auto-start proxy on program launch</label>
                         </div>
+                        <div class="form-check form-switch">
+                            <input class="form-check-input" type="checkbox" id="notifyInterfaceChanges">
+                            <label class="form-check-label" for="notifyInterfaceChanges">Show interface changes in the tray tooltip</label>
+                        </div>
+                        <div class="form-check form-switch">
+                            <input class="form-check-input" type="checkbox" id="listenIPv6">
+                            <label class="form-check-label" for="listenIPv6">Also listen on IPv6 loopback ([::1])</label>
+                        </div>
+                    </div>
+                </div>
+
+                <div class="card">
+                    <div class="card-header fw-bold">Profiles</div>
+                    <div class="card-body">
+                        <div class="form-check form-switch mb-2">
+                            <input class="form-check-input" type="checkbox" id="autoProfile">
+                            <label class="form-check-label" for="autoProfile">Select the profile automatically from the network</label>
+                        </div>
+                        <table class="table table-sm align-middle mb-2">
+                            <thead><tr><th>Profile</th><th>Gateway</th><th>Interface</th><th>Subnet</th><th>Probe</th><th style="width: 40px"></th></tr></thead>
+                            <tbody id="profilesBody"></tbody>
+                        </table>
+                        <div class="form-text">A profile is selected when all of its conditions hold; the first match in name order wins. Subnets are checked on the default outbound's interface, and the probe must accept a TCP connection.</div>
+                        <div class="form-text" id="networkInfo"></div>
                     </div>
                 </div>
             </div>
@@ -701,6 +1037,17 @@ func main() {
                     </div>
                     <div class="card-body p-0"><div id="log"></div></div>
                 </div>
+
+                <div class="card">
+                    <div class="card-header fw-bold">Config History</div>
+                    <div class="card-body">
+                        <table class="table table-sm align-middle mb-2">
+                            <thead><tr><th>Saved</th><th>Size</th><th style="width: 90px"></th></tr></thead>
+                            <tbody id="backupsBody"></tbody>
+                        </table>
+                        <pre id="backupDiff" class="d-none border rounded p-2 mb-0"></pre>
+                    </div>
+                </div>
             </div>
         </div>
 
@@ -718,13 +1065,428 @@ func main() {
 
     <script src="https://cdn.jsdelivr.net/npm/bootstrap@5.3.0/dist/js/bootstrap.bundle.min.js"></script>
     <script>
+        let ifaceNames = [];
         async function refreshInterfaces() {
             const ifaces = await fetch('/api/interfaces').then(r => r.json());
-            ['defaultIface', 'gfwIface', 'companyIface'].forEach(id => {
-                const sel = document.getElementById(id);
-                const currentVal = sel.value;
-                sel.innerHTML = '<option value="">None</option>' + ifaces.map(i => ` + "`" + `<option value="${i.name}">${i.name}</option>` + "`" + `).join('');
-                if(currentVal) sel.value = currentVal;
+            ifaceNames = (ifaces || []).map(i => i.name);
+            renderOutbounds();
+        }
+
+        let currentConfig = {};
+        let rules = [];
+        let outbounds = [];
+        const ruleTypes = ['domain', 'domain-suffix', 'domain-keyword', 'regex', 'cidr', 'port', 'list'];
+
+        function options(values, selected, labels) {
+            if (selected && !values.includes(selected)) values = values.concat([selected]);
+            return values.map(v => '<option value="' + escapeAttr(v) + '"' + (v === selected ? ' selected' : '') + '>' + escapeAttr((labels || {})[v] || v) + '</option>').join('');
+        }
+
+        function outboundNames() {
+            return outbounds.map(o => o.name).filter(n => n).concat(['reject']);
+        }
+
+        const outboundTypes = ['interface', 'socks5', 'http'];
+
+        function outboundInput(i, field, placeholder, title, type) {
+            const o = outbounds[i];
+            const value = o[field] === undefined || o[field] === 0 ? '' : o[field];
+            const parse = type === 'number' ? 'parseInt(this.value) || 0' : 'this.value.trim()';
+            return '<input' + (type ? ' type="' + type + '"' : '') + ' class="form-control form-control-sm" placeholder="' + placeholder + '" title="' + title + '" value="' + escapeAttr(value) + '"' + outboundField(i, field) + ' oninput="outbounds[' + i + '].' + field + ' = ' + parse + '">';
+        }
+
+        function outboundField(i, field) {
+            return ' data-field="' + escapeAttr('outbounds.' + outbounds[i].name + '.' + field) + '"';
+        }
+
+        function setOutboundIface(i, value) {
+            const o = outbounds[i];
+            if (value === '*') {
+                o.ifaceMatch = o.ifaceMatch || { name: '' };
+                o.iface = '';
+            } else {
+                delete o.ifaceMatch;
+                o.iface = value;
+            }
+            renderOutbounds();
+        }
+
+        function ifaceMatchRow(i) {
+            const m = outbounds[i].ifaceMatch;
+            if (!m) return '';
+            const input = (field, placeholder, title, value, parse) => '<input class="form-control" placeholder="' + placeholder + '" title="' + title + '" value="' + escapeAttr(value) + '"' +
+                (field === 'name' ? outboundField(i, 'ifaceMatch') : '') + ' oninput="outbounds[' + i + '].ifaceMatch.' + field + ' = ' + parse + '">';
+            return '<div class="col-9 offset-3"><div class="input-group input-group-sm">' +
+                input('name', 'name, e.g. utun*', 'Interface name glob', m.name || '', 'this.value.trim()') +
+                input('cidr', 'address in, e.g. 10.8.0.0/16', 'A network that holds one of the interface addresses', m.cidr || '', 'this.value.trim()') +
+                input('mtu', 'MTU', 'Exact MTU', m.mtu || '', 'parseInt(this.value) || 0') +
+                input('flags', 'flags, e.g. pointtopoint', 'Flags that must be set: up, broadcast, pointtopoint, multicast, running', (m.flags || []).join(', '), 'splitList(this.value)') +
+                '</div></div>';
+        }
+
+        let health = {};
+        const healthCheckLabels = { '': 'No health check', tcp: 'TCP connect', http: 'HTTP(S) GET' };
+
+        function setHealthCheck(i, type) {
+            const o = outbounds[i];
+            if (type) {
+                o.healthCheck = Object.assign(o.healthCheck || { target: '' }, { type: type });
+            } else {
+                delete o.healthCheck;
+            }
+            renderOutbounds();
+        }
+
+        function healthCheckRow(i) {
+            const c = outbounds[i].healthCheck;
+            let html = '<div class="col-3 offset-3"><select class="form-select form-select-sm" title="While the check fails, rules with a fallback use the fallback"' + outboundField(i, 'healthCheck.type') + ' onchange="setHealthCheck(' + i + ', this.value)">' + options(['', 'tcp', 'http'], c ? c.type : '', healthCheckLabels) + '</select></div>';
+            if (!c) return html + '<div class="col-6"><small class="text-muted" data-health="' + escapeAttr(outbounds[i].name) + '"></small></div>';
+            return html +
+                '<div class="col-4"><input class="form-control form-control-sm" placeholder="' + (c.type === 'http' ? 'https://www.google.com/generate_204' : 'host:port, e.g. 8.8.8.8:53') + '" title="Probed through this outbound" value="' + escapeAttr(c.target || '') + '"' + outboundField(i, 'healthCheck.target') + ' oninput="outbounds[' + i + '].healthCheck.target = this.value.trim()"></div>' +
+                '<div class="col-2"><div class="input-group input-group-sm"><input type="number" min="5" class="form-control" placeholder="30" title="Seconds between checks" value="' + (c.interval || '') + '"' + outboundField(i, 'healthCheck.interval') + ' oninput="outbounds[' + i + '].healthCheck.interval = parseInt(this.value) || 0"><span class="input-group-text">s</span></div></div>' +
+                '<div class="col-9 offset-3"><small data-health="' + escapeAttr(outbounds[i].name) + '"></small></div>';
+        }
+
+        function healthText(st) {
+            if (!st) return { text: '', cls: 'text-muted' };
+            const iface = st.iface ? 'via ' + st.iface : '';
+            const since = st.since ? ' since ' + new Date(st.since).toLocaleTimeString() : '';
+            switch (st.state) {
+            case 'up':
+                return { text: ['Up' + since + ' (' + st.latencyMs + ' ms)', iface].filter(s => s).join(' · '), cls: 'text-success' };
+            case 'down':
+                return { text: ['Down' + since + ': ' + st.lastError, iface].filter(s => s).join(' · '), cls: 'text-danger' };
+            case 'pending':
+                return { text: ['Checking…', iface].filter(s => s).join(' · '), cls: 'text-muted' };
+            }
+            return { text: iface, cls: 'text-muted' };
+        }
+
+        function showHealth() {
+            document.querySelectorAll('[data-health]').forEach(el => {
+                const st = healthText(health[el.dataset.health]);
+                el.textContent = st.text;
+                el.className = st.cls;
+            });
+        }
+
+        async function refreshHealth() {
+            try {
+                const statuses = await fetch('/api/health').then(r => r.json());
+                health = Object.fromEntries((statuses || []).map(st => [st.outbound, st]));
+                showHealth();
+            } catch (e) {}
+        }
+
+        function renderOutbounds() {
+            document.getElementById('outboundsBody').innerHTML = outbounds.map((o, i) => {
+                const proxy = o.type === 'socks5' || o.type === 'http';
+                const details = proxy
+                    ? '<div class="col-3 offset-3">' + outboundInput(i, 'server', 'host:port', 'Upstream proxy address, e.g. 127.0.0.1:7890') + '</div>' +
+                      '<div class="col-3">' + outboundInput(i, 'username', 'username', 'Upstream proxy username (optional)') + '</div>' +
+                      '<div class="col-3">' + outboundInput(i, 'password', 'password', 'Upstream proxy password (optional)', 'password') + '</div>' +
+                      ifaceMatchRow(i) +
+                      healthCheckRow(i)
+                    : '<div class="col-3 offset-3">' + outboundInput(i, 'sourceIp', 'IPv4 src', 'Source IPv4 (empty = interface address)') + '</div>' +
+                      '<div class="col-3">' + outboundInput(i, 'sourceIpv6', 'IPv6 src', 'Source IPv6 (empty = interface address)') + '</div>' +
+                      '<div class="col-3">' + outboundInput(i, 'fwMark', 'fwmark', 'Linux SO_MARK (used when binding mode is SO_MARK)', 'number') + '</div>' +
+                      ifaceMatchRow(i) +
+                      '<div class="col-9 offset-3"><input class="form-control form-control-sm" placeholder="DNS servers, e.g. 8.8.8.8, tls://1.1.1.1, https://dns.google/dns-query" title="Resolvers queried through this outbound (empty = system resolver)" value="' + escapeAttr((o.dns || []).join(', ')) + '"' + outboundField(i, 'dns') + ' oninput="outbounds[' + i + '].dns = splitList(this.value)"></div>' +
+                      healthCheckRow(i);
+                return '<div class="row g-1 mb-2 align-items-center">' +
+                    '<div class="col-3"><input class="form-control form-control-sm" placeholder="name" value="' + escapeAttr(o.name) + '"' + outboundField(i, 'name') + ' onchange="outbounds[' + i + '].name = this.value.trim(); renderRules(); renderLists()"></div>' +
+                    '<div class="col-3"><select class="form-select form-select-sm"' + outboundField(i, 'type') + ' onchange="outbounds[' + i + '].type = this.value; renderOutbounds()">' + options(outboundTypes, o.type || 'interface') + '</select></div>' +
+                    '<div class="col-5"><div class="input-group input-group-sm">' +
+                    '<select class="form-select form-select-sm" title="' + (proxy ? 'Interface used to reach the upstream proxy' : 'Interface') + '"' + outboundField(i, 'iface') + ' onchange="setOutboundIface(' + i + ', this.value)">' + options([''].concat(ifaceNames, ['*']), o.ifaceMatch ? '*' : o.iface || '', { '': 'None', '*': 'Match…' }) + '</select>' +
+                    '<button class="btn btn-outline-secondary" type="button" onclick="autoDetect(' + i + ')" title="Auto Detect"><i class="bi bi-search"></i></button>' +
+                    '</div></div>' +
+                    '<div class="col-1 text-end"><button class="btn btn-sm btn-link text-danger p-0" onclick="removeOutbound(' + i + ')" title="Delete"><i class="bi bi-x-lg"></i></button></div>' +
+                    details +
+                    '</div>';
+            }).join('');
+            showHealth();
+        }
+
+        function addOutbound() {
+            outbounds.push({ name: '', iface: '' });
+            renderOutbounds();
+        }
+
+        function removeOutbound(i) {
+            outbounds.splice(i, 1);
+            renderOutbounds();
+            renderRules();
+            renderLists();
+        }
+
+        function escapeAttr(s) {
+            return String(s).replace(/&/g, '&amp;').replace(/"/g, '&quot;').replace(/</g, '&lt;');
+        }
+
+        function splitList(s) {
+            return s.split(',').map(v => v.trim()).filter(v => v);
+        }
+
+        function renderRules() {
+            document.getElementById('rulesBody').innerHTML = rules.map((r, i) =>
+                '<tr>' +
+                '<td><select class="form-select form-select-sm" data-field="rules[' + i + '].type" onchange="rules[' + i + '].type = this.value; renderRules()">' + options(ruleTypes, r.type) + '</select></td>' +
+                '<td><input class="form-control form-control-sm" data-field="rules[' + i + '].value"' + (r.type === 'list' ? ' placeholder="list name"' : '') + ' value="' + escapeAttr(r.value || '') + '" oninput="rules[' + i + '].value = this.value"></td>' +
+                '<td><select class="form-select form-select-sm" data-field="rules[' + i + '].outbound" onchange="rules[' + i + '].outbound = this.value">' + (r.type === 'list'
+                    ? options([''].concat(outboundNames()), r.outbound || '', { '': "list's" })
+                    : options(outboundNames(), r.outbound)) + '</select></td>' +
+                '<td><select class="form-select form-select-sm" data-field="rules[' + i + '].fallback" title="Outbound used while the outbound is down: its interface is missing or it fails its health check" onchange="rules[' + i + '].fallback = this.value">' + options([''].concat(outboundNames()), r.fallback || '', { '': 'None' }) + '</select></td>' +
+                '<td><input class="form-control form-control-sm" data-field="rules[' + i + '].dns" placeholder="outbound\'s" title="DNS servers for matching hosts, queried through the outbound (comma separated)" value="' + escapeAttr((r.dns || []).join(', ')) + '" oninput="rules[' + i + '].dns = splitList(this.value)"></td>' +
+                '<td class="text-nowrap">' +
+                '<button class="btn btn-sm btn-link p-0 me-1" onclick="moveRule(' + i + ', -1)" title="Up"><i class="bi bi-arrow-up"></i></button>' +
+                '<button class="btn btn-sm btn-link p-0 me-1" onclick="moveRule(' + i + ', 1)" title="Down"><i class="bi bi-arrow-down"></i></button>' +
+                '<button class="btn btn-sm btn-link text-danger p-0" onclick="removeRule(' + i + ')" title="Delete"><i class="bi bi-x-lg"></i></button>' +
+                '</td></tr>'
+            ).join('');
+        }
+
+        function addRule() {
+            rules.push({ type: 'domain-suffix', value: '', outbound: 'default' });
+            renderRules();
+        }
+
+        function removeRule(i) {
+            rules.splice(i, 1);
+            renderRules();
+        }
+
+        function moveRule(i, delta) {
+            const j = i + delta;
+            if (j < 0 || j >= rules.length) return;
+            [rules[i], rules[j]] = [rules[j], rules[i]];
+            renderRules();
+        }
+
+        let lists = [];
+        let listStatus = {};
+        const listFormats = ['abp', 'domains', 'clash', 'dnsmasq'];
+        const listFormatLabels = { abp: 'GFWList / ABP', domains: 'Domain list', clash: 'Clash provider', dnsmasq: 'dnsmasq conf' };
+
+        function listInput(i, field, placeholder, title, type) {
+            const l = lists[i];
+            const value = l[field] === undefined || l[field] === 0 ? '' : l[field];
+            const parse = type === 'number' ? 'parseInt(this.value) || 0' : 'this.value.trim()';
+            return '<input' + (type ? ' type="' + type + '" min="1"' : '') + ' class="form-control form-control-sm" placeholder="' + placeholder + '" title="' + title + '" value="' + escapeAttr(value) + '" data-field="lists[' + i + '].' + field + '" oninput="lists[' + i + '].' + field + ' = ' + parse + '">';
+        }
+
+        function listStatusText(st) {
+            if (!st) return { text: 'Not loaded yet', error: false };
+            const parts = [];
+            parts.push(st.updated && !st.updated.startsWith('0001') ? 'Updated ' + new Date(st.updated).toLocaleString() : 'Never updated');
+            parts.push(st.entries + ' entries' + (st.exceptions ? ', ' + st.exceptions + ' exceptions' : ''));
+            if (st.warnings.length) parts.push(st.warnings.length + ' skipped');
+            return { text: parts.join(' · ') + (st.lastError ? ' · Last error: ' + st.lastError : ''), error: !!st.lastError };
+        }
+
+        function renderLists() {
+            document.getElementById('listsBody').innerHTML = lists.map((l, i) => {
+                const st = listStatusText(listStatus[l.name]);
+                return '<div class="row g-1 mb-3 align-items-center">' +
+                    '<div class="col-3">' + listInput(i, 'name', 'name', 'Name rules use to reference the list') + '</div>' +
+                    '<div class="col-3"><select class="form-select form-select-sm" data-field="lists[' + i + '].format" onchange="lists[' + i + '].format = this.value">' + options(listFormats, l.format || 'abp', listFormatLabels) + '</select></div>' +
+                    '<div class="col-3"><select class="form-select form-select-sm" title="Outbound for matching traffic, unless a rule references the list" data-field="lists[' + i + '].outbound" onchange="lists[' + i + '].outbound = this.value">' + options(outboundNames(), l.outbound) + '</select></div>' +
+                    '<div class="col-2"><div class="input-group input-group-sm">' + listInput(i, 'updateHours', '24', 'Update interval of a remote list', 'number') + '<span class="input-group-text">h</span></div></div>' +
+                    '<div class="col-1 text-end"><button class="btn btn-sm btn-link text-danger p-0" onclick="removeList(' + i + ')" title="Delete"><i class="bi bi-x-lg"></i></button></div>' +
+                    '<div class="col-12">' + listInput(i, 'url', 'https://… or a local path', 'List URL, or a path relative to the config directory') + '</div>' +
+                    '<div class="col-7"><input class="form-control form-control-sm" placeholder="Mirror URLs (comma separated, tried after the main URL)" value="' + escapeAttr((l.mirrors || []).join(', ')) + '" data-field="lists[' + i + '].mirrors" oninput="lists[' + i + '].mirrors = splitList(this.value)"></div>' +
+                    '<div class="col-5"><input class="form-control form-control-sm" placeholder="gfw, default" title="Outbounds to download the list through, in order" value="' + escapeAttr((l.via || []).join(', ')) + '" data-field="lists[' + i + '].via" oninput="lists[' + i + '].via = splitList(this.value)"></div>' +
+                    '<div class="col-10"><small class="' + (st.error ? 'text-danger' : 'text-muted') + '">' + escapeAttr(st.text) + '</small></div>' +
+                    '<div class="col-2 text-end"><button class="btn btn-sm btn-outline-secondary" type="button" onclick="updateList(' + i + ', this)" title="Update Now"><i class="bi bi-arrow-repeat"></i></button></div>' +
+                    '</div>';
+            }).join('');
+        }
+
+        function addList() {
+            lists.push({ name: '', format: 'domains', url: '', outbound: 'default' });
+            renderLists();
+        }
+
+        function removeList(i) {
+            lists.splice(i, 1);
+            renderLists();
+        }
+
+        async function refreshListStatus() {
+            const statuses = await fetch('/api/lists').then(r => r.json());
+            listStatus = Object.fromEntries((statuses || []).map(st => [st.name, st]));
+            renderLists();
+        }
+
+        async function updateList(i, btn) {
+            const name = lists[i].name;
+            btn.disabled = true;
+            try {
+                const res = await fetch('/api/lists/update?name=' + encodeURIComponent(name), { method: 'POST' });
+                if (res.ok) {
+                    listStatus[name] = await res.json();
+                    renderLists();
+                }
+            } finally {
+                btn.disabled = false;
+            }
+        }
+
+        async function refreshBackups() {
+            const backups = await fetch('/api/backups').then(r => r.json());
+            document.getElementById('backupsBody').innerHTML = (backups || []).length
+                ? backups.map(b => '<tr>' +
+                    '<td>' + escapeAttr(new Date(b.time).toLocaleString()) + '</td>' +
+                    '<td>' + (b.size / 1024).toFixed(1) + ' KB</td>' +
+                    '<td class="text-end text-nowrap">' +
+                    '<button class="btn btn-sm btn-link p-0 me-2" onclick="showBackupDiff(\'' + escapeAttr(b.id) + '\')" title="Diff against current"><i class="bi bi-file-diff"></i></button>' +
+                    '<button class="btn btn-sm btn-link p-0" onclick="restoreBackup(\'' + escapeAttr(b.id) + '\')" title="Restore"><i class="bi bi-arrow-counterclockwise"></i></button>' +
+                    '</td></tr>').join('')
+                : '<tr><td colspan="3" class="text-muted">No previous versions yet.</td></tr>';
+        }
+
+        async function showBackupDiff(id) {
+            const res = await fetch('/api/backups/diff?id=' + encodeURIComponent(id));
+            const pre = document.getElementById('backupDiff');
+            pre.classList.remove('d-none');
+            if (!res.ok) {
+                pre.textContent = await res.text();
+                return;
+            }
+            const diff = (await res.json()).diff;
+            // Lines starting with - are in the backup, + in the current config.
+            pre.innerHTML = diff ? diff.split('\n').map(line => {
+                const cls = line[0] === '+' ? 'add' : line[0] === '-' ? 'del' : '';
+                return '<span class="' + cls + '">' + escapeAttr(line) + '</span>';
+            }).join('\n') : 'Identical to the current configuration.';
+        }
+
+        async function restoreBackup(id) {
+            if (!confirm('Restore this version? The current configuration is kept in the history.')) return;
+            const res = await fetch('/api/backups/restore?id=' + encodeURIComponent(id), { method: 'POST' });
+            const toastEl = document.getElementById('liveToast');
+            let message = 'Configuration restored and applied.';
+            if (res.status === 400) {
+                message = 'This version is not a valid configuration: ' + ((await res.json()).errors || []).map(e => (e.field ? e.field + ': ' : '') + e.message).join('; ');
+            } else if (!res.ok) {
+                message = 'Restore failed: ' + (await res.text());
+            }
+            toastEl.querySelector('.toast-body').innerText = message;
+            toastEl.classList.toggle('bg-success', res.ok);
+            toastEl.classList.toggle('bg-danger', !res.ok);
+            new bootstrap.Toast(toastEl).show();
+            document.getElementById('backupDiff').classList.add('d-none');
+            if (res.ok) await loadData();
+        }
+
+        function setOutbounds(obj) {
+            outbounds = Object.entries(obj || {}).map(([name, o]) => Object.assign({ name: name }, o));
+            outbounds.sort((a, b) => (a.name === 'default' ? -1 : b.name === 'default' ? 1 : a.name.localeCompare(b.name)));
+            renderOutbounds();
+        }
+
+        function outboundsObject() {
+            return Object.fromEntries(outbounds.filter(o => o.name).map(o => {
+                const { name, ...rest } = o;
+                return [name, rest];
+            }));
+        }
+
+        function renderProfiles() {
+            const names = Object.keys(currentConfig.profiles || {}).sort();
+            const select = document.getElementById('profileSelect');
+            select.innerHTML = names.length ? options(names, currentConfig.activeProfile) : '<option value="">None</option>';
+            select.disabled = !names.length;
+            document.getElementById('btnDeleteProfile').disabled = !names.length;
+
+            const matchInput = (i, field, placeholder) => {
+                const m = currentConfig.profiles[names[i]].match || {};
+                return '<td><input class="form-control form-control-sm" placeholder="' + placeholder + '" value="' + escapeAttr(m[field] || '') + '"' +
+                    ' data-field="' + escapeAttr('profiles.' + names[i] + '.match.' + field) + '" oninput="setProfileMatch(' + i + ', \'' + field + '\', this.value)"></td>';
+            };
+            profileRows = names;
+            document.getElementById('profilesBody').innerHTML = names.length ? names.map((name, i) => '<tr>' +
+                '<td>' + escapeAttr(name) + '</td>' +
+                matchInput(i, 'gateway', '192.168.1.1') +
+                matchInput(i, 'iface', 'utun3') +
+                matchInput(i, 'subnet', '10.1.0.0/16') +
+                matchInput(i, 'probe', 'intranet.corp:443') +
+                '<td class="text-end"><button class="btn btn-sm btn-link p-0" type="button" onclick="useCurrentNetwork(' + i + ')" title="Use the current gateway and subnet"><i class="bi bi-geo-alt"></i></button></td>' +
+                '</tr>').join('') : '<tr><td colspan="6" class="text-muted">Create a profile with + in the header first.</td></tr>';
+        }
+
+        let profileRows = [];
+        function setProfileMatch(i, field, value) {
+            const prof = currentConfig.profiles[profileRows[i]];
+            prof.match = Object.assign({}, prof.match, { [field]: value.trim() });
+        }
+
+        async function refreshNetwork() {
+            const net = await fetch('/api/network').then(r => r.json());
+            document.getElementById('networkInfo').textContent = 'Current network: gateway ' + (net.gateway || 'none') +
+                (net.defaultIface ? ' via ' + net.defaultIface : '') + (net.subnet ? ' (' + net.subnet + ')' : '') +
+                (net.profile ? ', matches profile ' + net.profile : ', matches no profile') + '.';
+            return net;
+        }
+
+        async function useCurrentNetwork(i) {
+            const net = await refreshNetwork();
+            const prof = currentConfig.profiles[profileRows[i]];
+            prof.match = Object.assign({}, prof.match, { gateway: net.gateway || '', subnet: net.subnet || '' });
+            renderProfiles();
+        }
+
+        async function switchProfile(name) {
+            const res = await fetch('/api/profiles/switch?name=' + encodeURIComponent(name), { method: 'POST' });
+            if (!res.ok) {
+                const toastEl = document.getElementById('liveToast');
+                toastEl.querySelector('.toast-body').innerText = 'Profile not switched: ' + (await res.text());
+                toastEl.classList.replace('bg-success', 'bg-danger');
+                new bootstrap.Toast(toastEl).show();
+                renderProfiles();
+                return;
+            }
+            await loadData();
+        }
+
+        function newProfile() {
+            const name = (prompt('Name of the new profile. It starts as a copy of the current outbounds and rules.') || '').trim();
+            if (!name) return;
+            const profiles = Object.assign({}, currentConfig.profiles);
+            if (profiles[name]) {
+                alert('A profile named ' + name + ' already exists.');
+                return;
+            }
+            // The current settings stay in the active profile and are copied into the new one.
+            const current = { outbounds: outboundsObject(), rules: rules.filter(r => r.value.trim()) };
+            if (currentConfig.activeProfile) {
+                profiles[currentConfig.activeProfile] = Object.assign({}, profiles[currentConfig.activeProfile], current);
+            }
+            profiles[name] = current;
+            currentConfig.profiles = profiles;
+            currentConfig.activeProfile = name;
+            saveConfig();
+        }
+
+        function deleteProfile() {
+            const name = currentConfig.activeProfile;
+            if (!name || !confirm('Delete the profile ' + name + '?')) return;
+            const profiles = Object.assign({}, currentConfig.profiles);
+            delete profiles[name];
+            const next = Object.keys(profiles).sort()[0];
+            currentConfig.profiles = profiles;
+            currentConfig.activeProfile = next || '';
+            if (next) {
+                setOutbounds(profiles[next].outbounds);
+                rules = profiles[next].rules || [];
+                renderRules();
+            }
+            saveConfig();
+        }
+
+        function parseUsers(text) {
+            return text.split('\n').map(s => s.trim()).filter(s => s).map(line => {
+                const i = line.indexOf(':');
+                return i === -1 ? { username: line, password: '' } : { username: line.slice(0, i), password: line.slice(i + 1) };
             });
         }
 
@@ -732,33 +1494,90 @@ func main() {
             try {
                 await refreshInterfaces();
                 const config = await fetch('/api/config').then(r => r.json());
+                currentConfig = config;
+                document.getElementById('pacUrl').textContent = location.origin + '/proxy.pac';
                 document.getElementById('proxyPort').value = config.port || 1080;
-                document.getElementById('defaultIface').value = config.defaultIface || '';
-                document.getElementById('gfwIface').value = config.gfwIface || '';
-                document.getElementById('companyIface').value = config.companyIface || '';
-                document.getElementById('companyDomains').value = (config.companyDomains || []).join(', ');
-                document.getElementById('bypassDomains').value = (config.bypassDomains || []).join(', ');
-                document.getElementById('extraGfwDomains').value = (config.extraGfwDomains || []).join(', ');
-                document.getElementById('gfwlistUrl').value = config.gfwlistUrl || '';
+                document.getElementById('httpPort').value = config.httpPort || '';
+                setOutbounds(config.outbounds);
+                rules = config.rules || [];
+                renderRules();
+                renderProfiles();
+                refreshNetwork();
+                document.getElementById('autoProfile').checked = config.autoProfile;
+                lists = config.lists || [];
+                refreshListStatus();
+                refreshHealth();
+                refreshBackups();
                 document.getElementById('autoStart').checked = config.autoStart;
+                document.getElementById('listenIPv6').checked = config.listenIPv6;
+                document.getElementById('notifyInterfaceChanges').checked = config.notifyInterfaceChanges;
+                const linuxBind = config.linuxBind || {};
+                document.getElementById('linuxBindMode').value = linuxBind.mode || 'device';
+                const dnsServer = config.dnsServer || {};
+                document.getElementById('dnsServerEnabled').checked = dnsServer.enabled;
+                document.getElementById('dnsServerListen').value = dnsServer.listen || '';
+                document.getElementById('authUsers').value = ((config.auth || {}).users || []).map(u => u.username + ':' + u.password).join('\n');
             } catch(e) { console.error("load error", e); }
         }
 
+        function showFieldErrors(errors) {
+            document.querySelectorAll('.field-error').forEach(el => el.remove());
+            document.querySelectorAll('.is-invalid').forEach(el => el.classList.remove('is-invalid'));
+            const unplaced = [];
+            (errors || []).forEach(e => {
+                const el = e.field && document.querySelector('[data-field="' + CSS.escape(e.field) + '"]');
+                if (!el) {
+                    unplaced.push((e.field ? e.field + ': ' : '') + e.message);
+                    return;
+                }
+                el.classList.add('is-invalid');
+                const msg = document.createElement('div');
+                msg.className = 'invalid-feedback d-block field-error';
+                msg.textContent = e.message;
+                (el.closest('.input-group') || el).after(msg);
+            });
+            return unplaced;
+        }
+
         async function saveConfig() {
-            const body = {
+            // Drop blank rows so the indices in field errors match the inputs.
+            outbounds = outbounds.filter(o => o.name);
+            rules = rules.filter(r => r.value.trim());
+            lists = lists.filter(l => l.name);
+            renderOutbounds();
+            renderRules();
+            renderLists();
+            renderProfiles();
+            const body = Object.assign({}, currentConfig, {
                 port: parseInt(document.getElementById('proxyPort').value),
-                defaultIface: document.getElementById('defaultIface').value,
-                gfwIface: document.getElementById('gfwIface').value,
-                companyIface: document.getElementById('companyIface').value,
-                companyDomains: document.getElementById('companyDomains').value.split(',').map(s => s.trim()).filter(s => s),
-                bypassDomains: document.getElementById('bypassDomains').value.split(',').map(s => s.trim()).filter(s => s),
-                extraGfwDomains: document.getElementById('extraGfwDomains').value.split(',').map(s => s.trim()).filter(s => s),
-                gfwlistUrl: document.getElementById('gfwlistUrl').value,
-                autoStart: document.getElementById('autoStart').checked
-            };
-            await fetch('/api/config', { method: 'POST', body: JSON.stringify(body) });
-            const toast = new bootstrap.Toast(document.getElementById('liveToast'));
-            toast.show();
+                httpPort: parseInt(document.getElementById('httpPort').value) || 0,
+                outbounds: outboundsObject(),
+                rules: rules,
+                lists: lists,
+                autoStart: document.getElementById('autoStart').checked,
+                listenIPv6: document.getElementById('listenIPv6').checked,
+                autoProfile: document.getElementById('autoProfile').checked,
+                notifyInterfaceChanges: document.getElementById('notifyInterfaceChanges').checked,
+                auth: { users: parseUsers(document.getElementById('authUsers').value) },
+                linuxBind: { mode: document.getElementById('linuxBindMode').value },
+                dnsServer: { enabled: document.getElementById('dnsServerEnabled').checked, listen: document.getElementById('dnsServerListen').value.trim() }
+            });
+            const res = await fetch('/api/config', { method: 'POST', body: JSON.stringify(body) });
+            const toastEl = document.getElementById('liveToast');
+            if (res.ok) {
+                showFieldErrors([]);
+                toastEl.querySelector('.toast-body').innerText = 'Configuration saved and applied.';
+                await loadData();
+            } else if (res.status === 400) {
+                const errors = (await res.json()).errors || [];
+                const unplaced = showFieldErrors(errors);
+                toastEl.querySelector('.toast-body').innerText = 'Please fix ' + errors.length + ' invalid setting' + (errors.length === 1 ? '' : 's') + '.' + (unplaced.length ? ' ' + unplaced.join('; ') : '');
+            } else {
+                toastEl.querySelector('.toast-body').innerText = 'Configuration not applied: ' + (await res.text());
+            }
+            toastEl.classList.toggle('bg-success', res.ok);
+            toastEl.classList.toggle('bg-danger', !res.ok);
+            new bootstrap.Toast(toastEl).show();
         }
 
         async function control(action) {
@@ -766,35 +1585,29 @@ func main() {
             updateStatus();
         }
 
-        async function autoDetectGFW() {
+        async function autoDetect(i) {
+            const name = outbounds[i].name;
+            if (!name) return;
             const btn = event.target.closest('button');
             const originalHtml = btn.innerHTML;
             btn.disabled = true;
-            btn.innerHTML = '<span class="spinner-border spinner-border-sm"></span> Testing...';
+            btn.innerHTML = '<span class="spinner-border spinner-border-sm"></span>';
             try {
                 await refreshInterfaces();
-                const res = await fetch('/api/autodetect-gfw', { method: 'POST' }).then(r => r.json());
-                document.getElementById('gfwIface').value = res.iface || '';
-                const toast = new bootstrap.Toast(document.getElementById('liveToast'));
-                document.querySelector('#liveToast .toast-body').innerText = res.iface ? ` + "`" + `Auto-detected GFW Interface: ${res.iface}` + "`" + ` : 'No working GFW interface found.';
-                toast.show();
-            } finally {
-                btn.disabled = false;
-                btn.innerHTML = originalHtml;
-            }
-        }
-
-        async function autoDetectCompany() {
-            const btn = event.target.closest('button');
-            const originalHtml = btn.innerHTML;
-            btn.disabled = true;
-            btn.innerHTML = '<span class="spinner-border spinner-border-sm"></span> Testing...';
-            try {
-                await refreshInterfaces();
-                const res = await fetch('/api/autodetect-company', { method: 'POST' }).then(r => r.json());
-                document.getElementById('companyIface').value = res.iface || '';
-                const toast = new bootstrap.Toast(document.getElementById('liveToast'));
-                document.querySelector('#liveToast .toast-body').innerText = res.iface ? ` + "`" + `Auto-detected Company Interface: ${res.iface}` + "`" + ` : 'No working Company interface found.';
+                const resp = await fetch('/api/autodetect?outbound=' + encodeURIComponent(name), { method: 'POST' });
+                const toastEl = document.getElementById('liveToast');
+                const toast = new bootstrap.Toast(toastEl);
+                if (!resp.ok) {
+                    toastEl.classList.replace('bg-success', 'bg-danger');
+                    toastEl.querySelector('.toast-body').innerText = 'Auto-detect failed: ' + (await resp.text());
+                    toast.show();
+                    return;
+                }
+                const res = await resp.json();
+                outbounds[i].iface = res.iface || '';
+                renderOutbounds();
+                toastEl.classList.replace('bg-danger', 'bg-success');
+                toastEl.querySelector('.toast-body').innerText = res.iface ? 'Auto-detected interface for ' + name + ': ' + res.iface : 'No working interface found for ' + name + '.';
                 toast.show();
             } finally {
                 btn.disabled = false;
@@ -829,6 +1642,7 @@ func main() {
 
         loadData();
         setInterval(updateStatus, 1000);
+        setInterval(refreshHealth, 5000);
     </script>
 </body>
 </html>
@@ -855,24 +1669,65 @@ func main() {
 
 		mStart := systray.AddMenuItem("Start Proxy", "Start the proxy server")
 		mStop := systray.AddMenuItem("Stop Proxy", "Stop the proxy server")
+		mProfiles := newProfileMenu(p)
 		systray.AddSeparator()
 		mOpen := systray.AddMenuItem("Open Configuration", "Open the configuration GUI")
 		systray.AddSeparator()
 		mQuit := systray.AddMenuItem("Quit", "Quit the application")
 
+		// The tray keeps its own copy of the running state and active profile:
+		// the callbacks may be called with p.mu held.
+		var trayMu sync.Mutex
+		var trayRunning bool
+		var trayProfile, trayNote string
+		updateTooltip := func() {
+			trayMu.Lock()
+			defer trayMu.Unlock()
+			tooltip := "Smart Proxy: Stopped"
+			if trayRunning {
+				tooltip = "Smart Proxy: Running"
+			}
+			if trayProfile != "" {
+				tooltip += " (" + trayProfile + ")"
+			}
+			if trayNote != "" {
+				tooltip += "\n" + trayNote
+			}
+			systray.SetTooltip(tooltip)
+		}
 		updateMenu := func(running bool) {
 			if running {
 				mStart.Disable()
 				mStop.Enable()
-				systray.SetTooltip("Smart Proxy: Running")
 			} else {
 				mStart.Enable()
 				mStop.Disable()
-				systray.SetTooltip("Smart Proxy: Stopped")
 			}
+			trayMu.Lock()
+			trayRunning = running
+			trayMu.Unlock()
+			updateTooltip()
+		}
+		updateProfiles := func(profiles []string, active string) {
+			mProfiles.update(profiles, active)
+			trayMu.Lock()
+			trayProfile = active
+			trayMu.Unlock()
+			updateTooltip()
 		}
 
 		p.onStatusChange = updateMenu
+		p.onProfileChange = updateProfiles
+		p.onInterfaceChange = func(summary string) {
+			trayMu.Lock()
+			trayNote = time.Now().Format("15:04") + " " + summary
+			trayMu.Unlock()
+			updateTooltip()
+		}
+		p.mu.RLock()
+		profiles, active := profileNames(&p.Config)
+		p.mu.RUnlock()
+		updateProfiles(profiles, active)
 		updateMenu(p.IsRunning())
 
 		go func() {
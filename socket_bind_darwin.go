@@ -12,10 +12,12 @@ const (
 	IPV6_BOUND_IF = 0x7D
 )
 
-func bindSocketToInterface(fd uintptr, network string, ifIndex int) {
-	if strings.Contains(network, "tcp6") {
-		_ = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, IPV6_BOUND_IF, ifIndex)
-	} else {
-		_ = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, IP_BOUND_IF, ifIndex)
+func bindSocketToInterface(fd uintptr, network string, b socketBinding) error {
+	if b.Index == 0 {
+		return nil
 	}
+	if strings.HasSuffix(network, "6") {
+		return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, IPV6_BOUND_IF, b.Index)
+	}
+	return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, IP_BOUND_IF, b.Index)
 }
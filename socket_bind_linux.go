@@ -0,0 +1,27 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// bindSocketToInterface pins the socket with SO_BINDTODEVICE, or tags it with
+// SO_MARK when a firewall mark is configured so that `ip rule` policy routing
+// picks the table. Both need CAP_NET_RAW / CAP_NET_ADMIN.
+func bindSocketToInterface(fd uintptr, network string, b socketBinding) error {
+	if b.Mark != 0 {
+		if err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, b.Mark); err != nil {
+			return fmt.Errorf("SO_MARK %d: %w", b.Mark, err)
+		}
+		return nil
+	}
+	if b.Name == "" {
+		return nil
+	}
+	if err := syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, b.Name); err != nil {
+		return fmt.Errorf("SO_BINDTODEVICE %s: %w", b.Name, err)
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
-//go:build !darwin
+//go:build !darwin && !linux
 
 package main
 
-func bindSocketToInterface(fd uintptr, network string, ifIndex int) {
+func bindSocketToInterface(fd uintptr, network string, b socketBinding) error {
+	return nil
 }
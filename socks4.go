@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+// SOCKS4 reply codes.
+const (
+	socks4Granted  = 0x5A
+	socks4Rejected = 0x5B
+)
+
+// handleSOCKS4 serves a SOCKS4 or SOCKS4a CONNECT request. SOCKS4 carries no
+// password, so it is refused while SOCKS5 users are configured.
+func (p *ProxyServer) handleSOCKS4(client net.Conn) {
+	defer client.Close()
+	br := bufio.NewReader(client)
+	var hdr [8]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil || hdr[0] != 0x04 {
+		return
+	}
+	cmd := hdr[1]
+	port := int(binary.BigEndian.Uint16(hdr[2:4]))
+	ip := net.IP(hdr[4:8])
+	userID, err := readNulString(br)
+	if err != nil {
+		return
+	}
+
+	host := ip.String()
+	// SOCKS4a: an address of 0.0.0.x (x != 0) means a hostname follows the user ID.
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		if host, err = readNulString(br); err != nil || host == "" {
+			return
+		}
+	}
+
+	p.mu.RLock()
+	authRequired := len(p.Config.Auth.Users) > 0
+	p.mu.RUnlock()
+	if authRequired {
+		p.addLog(fmt.Sprintf("SOCKS4 request from %s (user %q) refused: authentication is required", client.RemoteAddr(), userID))
+		writeSocks4Reply(client, socks4Rejected)
+		return
+	}
+	if cmd != socksCmdConnect {
+		writeSocks4Reply(client, socks4Rejected)
+		return
+	}
+
+	remote, err := p.dialRoute(host, port)
+	if err != nil {
+		writeSocks4Reply(client, socks4Rejected)
+		return
+	}
+	defer remote.Close()
+	writeSocks4Reply(client, socks4Granted)
+	relay(&bufferedConn{Conn: client, r: br}, remote)
+}
+
+// readNulString reads a NUL-terminated string of at most 255 bytes.
+func readNulString(r *bufio.Reader) (string, error) {
+	var b []byte
+	for len(b) < 256 {
+		c, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if c == 0 {
+			return string(b), nil
+		}
+		b = append(b, c)
+	}
+	return "", errors.New("SOCKS4 string too long")
+}
+
+func writeSocks4Reply(w io.Writer, code byte) error {
+	_, err := w.Write([]byte{0x00, code, 0, 0, 0, 0, 0, 0})
+	return err
+}
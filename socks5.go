@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+)
+
+const (
+	socksCmdConnect      = 0x01
+	socksCmdUDPAssociate = 0x03
+
+	socksAtypIPv4   = 0x01
+	socksAtypDomain = 0x03
+	socksAtypIPv6   = 0x04
+
+	socksRepSucceeded        = 0x00
+	socksRepNotAllowed       = 0x02
+	socksRepConnRefused      = 0x05
+	socksRepCmdNotSupported  = 0x07
+	socksRepAddrNotSupported = 0x08
+)
+
+var errUnsupportedAddrType = errors.New("unsupported SOCKS5 address type")
+
+// readSocksAddr reads ATYP, DST.ADDR and DST.PORT from a SOCKS5 request.
+func readSocksAddr(r io.Reader) (string, int, error) {
+	buf := make([]byte, 256)
+	if _, err := io.ReadFull(r, buf[:1]); err != nil {
+		return "", 0, err
+	}
+	var host string
+	switch buf[0] {
+	case socksAtypIPv4:
+		if _, err := io.ReadFull(r, buf[:4]); err != nil {
+			return "", 0, err
+		}
+		host = net.IP(buf[:4]).String()
+	case socksAtypDomain:
+		if _, err := io.ReadFull(r, buf[:1]); err != nil {
+			return "", 0, err
+		}
+		l := int(buf[0])
+		if _, err := io.ReadFull(r, buf[:l]); err != nil {
+			return "", 0, err
+		}
+		host = string(buf[:l])
+	case socksAtypIPv6:
+		if _, err := io.ReadFull(r, buf[:16]); err != nil {
+			return "", 0, err
+		}
+		host = net.IP(buf[:16]).String()
+	default:
+		return "", 0, errUnsupportedAddrType
+	}
+	if _, err := io.ReadFull(r, buf[:2]); err != nil {
+		return "", 0, err
+	}
+	return host, int(binary.BigEndian.Uint16(buf[:2])), nil
+}
+
+// parseSocksAddr decodes ATYP, ADDR and PORT at the start of b, as found in
+// SOCKS5 UDP request headers. It returns the number of bytes consumed.
+func parseSocksAddr(b []byte) (string, int, int, error) {
+	if len(b) < 1 {
+		return "", 0, 0, io.ErrUnexpectedEOF
+	}
+	var host string
+	n := 1
+	switch b[0] {
+	case socksAtypIPv4:
+		if len(b) < n+4 {
+			return "", 0, 0, io.ErrUnexpectedEOF
+		}
+		host = net.IP(b[n : n+4]).String()
+		n += 4
+	case socksAtypDomain:
+		if len(b) < n+1 {
+			return "", 0, 0, io.ErrUnexpectedEOF
+		}
+		l := int(b[n])
+		n++
+		if len(b) < n+l {
+			return "", 0, 0, io.ErrUnexpectedEOF
+		}
+		host = string(b[n : n+l])
+		n += l
+	case socksAtypIPv6:
+		if len(b) < n+16 {
+			return "", 0, 0, io.ErrUnexpectedEOF
+		}
+		host = net.IP(b[n : n+16]).String()
+		n += 16
+	default:
+		return "", 0, 0, errUnsupportedAddrType
+	}
+	if len(b) < n+2 {
+		return "", 0, 0, io.ErrUnexpectedEOF
+	}
+	port := int(binary.BigEndian.Uint16(b[n : n+2]))
+	return host, port, n + 2, nil
+}
+
+// appendSocksAddr encodes addr as ATYP, ADDR and PORT. A nil address is
+// encoded as 0.0.0.0:0.
+func appendSocksAddr(b []byte, addr net.Addr) []byte {
+	var ip net.IP
+	port := 0
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		b = append(b, socksAtypIPv4)
+		b = append(b, ip4...)
+	} else if ip6 := ip.To16(); ip6 != nil {
+		b = append(b, socksAtypIPv6)
+		b = append(b, ip6...)
+	} else {
+		b = append(b, socksAtypIPv4)
+		b = append(b, net.IPv4zero.To4()...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(port))
+}
+
+// writeSocksReply sends a SOCKS5 reply with the given REP code and BND address.
+func writeSocksReply(w io.Writer, rep byte, bound net.Addr) error {
+	_, err := w.Write(appendSocksAddr([]byte{0x05, rep, 0x00}, bound))
+	return err
+}
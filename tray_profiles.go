@@ -0,0 +1,77 @@
+package main
+
+import (
+	"log"
+	"sync"
+
+	"github.com/getlantern/systray"
+)
+
+// profileMenu is the tray submenu that lists the config profiles. systray
+// cannot remove menu items, so items are reused by position and the ones
+// beyond the current number of profiles are hidden.
+type profileMenu struct {
+	p      *ProxyServer
+	parent *systray.MenuItem
+	mu     sync.Mutex
+	items  []*systray.MenuItem
+	names  []string
+}
+
+func newProfileMenu(p *ProxyServer) *profileMenu {
+	m := &profileMenu{p: p, parent: systray.AddMenuItem("Profile", "Switch the config profile")}
+	m.parent.Hide()
+	return m
+}
+
+// update shows the given profiles with the active one checked.
+func (m *profileMenu) update(names []string, active string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, name := range names {
+		if i == len(m.items) {
+			item := m.parent.AddSubMenuItemCheckbox(name, "Switch to this profile", false)
+			m.items = append(m.items, item)
+			go m.watch(i, item)
+		}
+		item := m.items[i]
+		item.SetTitle(name)
+		item.Show()
+		if name == active {
+			item.Check()
+		} else {
+			item.Uncheck()
+		}
+	}
+	for _, item := range m.items[len(names):] {
+		item.Hide()
+	}
+	m.names = names
+	if len(names) == 0 {
+		m.parent.Hide()
+	} else {
+		m.parent.Show()
+	}
+}
+
+func (m *profileMenu) watch(i int, item *systray.MenuItem) {
+	for range item.ClickedCh {
+		m.mu.Lock()
+		var name string
+		if i < len(m.names) {
+			name = m.names[i]
+		}
+		m.mu.Unlock()
+		if name == "" {
+			continue
+		}
+		if err := m.p.switchProfile(name); err != nil {
+			log.Printf("Error switching profile: %v", err)
+			// Restore the check marks, which some platforms toggle on click.
+			m.p.mu.RLock()
+			names, active := profileNames(&m.p.Config)
+			m.p.mu.RUnlock()
+			m.update(names, active)
+		}
+	}
+}
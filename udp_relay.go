@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// udpRetryDelay is how long a destination that could not be routed is
+	// dropped before it is tried again.
+	udpRetryDelay = 5 * time.Second
+	// udpErrorLogInterval limits failure logging to once per destination in
+	// this interval, so a QUIC or game flow to a dead host cannot flood the log.
+	udpErrorLogInterval = time.Minute
+	// maxUDPDests bounds the per-association destination cache.
+	maxUDPDests = 1024
+)
+
+// udpDest is the cached routing of one destination of an association.
+type udpDest struct {
+	addr   *net.UDPAddr
+	out    net.PacketConn
+	err    error
+	retry  time.Time // when a failed destination is tried again
+	logged time.Time // when its last failure was logged
+}
+
+// udpRelay forwards SOCKS5 UDP datagrams for a single UDP ASSOCIATE session.
+// Each destination is routed through selectRoute once and cached for the
+// lifetime of the association, and one socket is kept per outbound and
+// address family so replies can be matched back to the client.
+type udpRelay struct {
+	p        *ProxyServer
+	conn     *net.UDPConn
+	clientIP net.IP
+
+	mu         sync.Mutex
+	clientAddr *net.UDPAddr
+	outbound   map[string]net.PacketConn
+	closed     bool
+
+	dests map[string]*udpDest // by host:port, only used by serve
+}
+
+func (p *ProxyServer) handleUDPAssociate(client net.Conn) {
+	localIP := client.LocalAddr().(*net.TCPAddr).IP
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: localIP})
+	if err != nil {
+		writeSocksReply(client, socksRepConnRefused, nil)
+		return
+	}
+
+	relay := &udpRelay{
+		p:        p,
+		conn:     conn,
+		clientIP: client.RemoteAddr().(*net.TCPAddr).IP,
+		outbound: make(map[string]net.PacketConn),
+		dests:    make(map[string]*udpDest),
+	}
+	defer relay.close()
+
+	if err := writeSocksReply(client, socksRepSucceeded, conn.LocalAddr()); err != nil {
+		return
+	}
+	p.addLog(fmt.Sprintf("UDP ASSOCIATE for %s relaying on %s", client.RemoteAddr(), conn.LocalAddr()))
+
+	go relay.serve()
+
+	// The association lives as long as the TCP control connection.
+	io.Copy(io.Discard, client)
+}
+
+func (r *udpRelay) serve() {
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := r.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if !from.IP.Equal(r.clientIP) {
+			continue
+		}
+		// RSV(2) FRAG(1); fragmented datagrams are not supported.
+		if n < 4 || buf[2] != 0x00 {
+			continue
+		}
+		host, port, hdrLen, err := parseSocksAddr(buf[3:n])
+		if err != nil {
+			continue
+		}
+
+		r.mu.Lock()
+		r.clientAddr = from
+		r.mu.Unlock()
+
+		if d := r.dest(host, port); d.err == nil {
+			d.out.WriteTo(buf[3+hdrLen:n], d.addr)
+		}
+	}
+}
+
+// dest returns the cached routing of host:port, routing it on first use and
+// again once a failure's retry delay has passed.
+func (r *udpRelay) dest(host string, port int) *udpDest {
+	key := net.JoinHostPort(host, strconv.Itoa(port))
+	now := time.Now()
+	d := r.dests[key]
+	if d != nil && (d.err == nil || now.Before(d.retry)) {
+		return d
+	}
+	if d == nil {
+		if len(r.dests) >= maxUDPDests {
+			clear(r.dests)
+		}
+		d = &udpDest{}
+		r.dests[key] = d
+	}
+
+	rt := r.p.selectRoute(host, port)
+	d.addr, d.out, d.err = r.route(rt, host, port)
+	if d.err != nil {
+		d.retry = now.Add(udpRetryDelay)
+		if now.Sub(d.logged) >= udpErrorLogInterval {
+			d.logged = now
+			r.p.addLog(fmt.Sprintf("UDP relay: cannot reach %s via %s: %v", host, rt.Outbound, d.err))
+		}
+	}
+	return d
+}
+
+// route resolves host to the first address whose family the outbound has a
+// source address for, and returns it with the matching socket.
+func (r *udpRelay) route(rt route, host string, port int) (*net.UDPAddr, net.PacketConn, error) {
+	outbound := rt.Outbound
+	if outbound == OutboundReject {
+		return nil, nil, errRejected
+	}
+	r.p.mu.RLock()
+	ob := r.p.Config.Outbounds[outbound]
+	r.p.mu.RUnlock()
+	if ob.isProxy() {
+		return nil, nil, fmt.Errorf("UDP is not supported through %s upstream proxies", ob.Type)
+	}
+	ips, err := r.p.resolveWith(outbound, rt.DNS, host)
+	if err != nil {
+		return nil, nil, err
+	}
+	_, ip4, ip6 := r.p.outboundLocal(outbound)
+	for _, ip := range ips {
+		local, ok := sourceIPFor(ip, ip4, ip6)
+		if !ok {
+			continue
+		}
+		out, err := r.outboundFor(outbound, ip.To4() == nil, local)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &net.UDPAddr{IP: ip, Port: port}, out, nil
+	}
+	return nil, nil, fmt.Errorf("no source address for %s", host)
+}
+
+// outboundFor returns the socket of the named outbound for the given address
+// family, opening it on first use.
+func (r *udpRelay) outboundFor(outbound string, v6 bool, local net.IP) (net.PacketConn, error) {
+	network, key := "udp4", outbound+"/4"
+	if v6 {
+		network, key = "udp6", outbound+"/6"
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil, net.ErrClosed
+	}
+	if out, ok := r.outbound[key]; ok {
+		return out, nil
+	}
+
+	binding, _, _ := r.p.outboundLocal(outbound)
+	lc := net.ListenConfig{Control: ifaceControl(binding)}
+	out, err := lc.ListenPacket(context.Background(), network, (&net.UDPAddr{IP: local}).String())
+	if err != nil {
+		return nil, err
+	}
+	r.outbound[key] = out
+	go r.pipeReplies(out)
+	return out, nil
+}
+
+// pipeReplies wraps datagrams received on out in a SOCKS5 UDP header and
+// sends them back to the client.
+func (r *udpRelay) pipeReplies(out net.PacketConn) {
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := out.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		r.mu.Lock()
+		clientAddr := r.clientAddr
+		r.mu.Unlock()
+		if clientAddr == nil {
+			continue
+		}
+		pkt := appendSocksAddr([]byte{0x00, 0x00, 0x00}, from)
+		pkt = append(pkt, buf[:n]...)
+		r.conn.WriteToUDP(pkt, clientAddr)
+	}
+}
+
+func (r *udpRelay) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	r.conn.Close()
+	for _, out := range r.outbound {
+		out.Close()
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// bufferedConn is a net.Conn whose reads drain a bufio.Reader first, so bytes
+// read ahead while parsing a handshake are not lost.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// socks5Connect performs a SOCKS5 CONNECT to addr over conn, authenticating
+// with username/password (RFC 1929) when a username is set. Hostnames are
+// sent as-is so the upstream resolves them.
+func socks5Connect(conn net.Conn, username, password, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return err
+	}
+
+	methods := []byte{socksMethodNoAuth}
+	if username != "" {
+		methods = append(methods, socksMethodUserPass)
+	}
+	if _, err := conn.Write(append([]byte{0x05, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return err
+	}
+	if buf[0] != 0x05 {
+		return errors.New("not a SOCKS5 server")
+	}
+	switch buf[1] {
+	case socksMethodNoAuth:
+	case socksMethodUserPass:
+		if len(username) > 255 || len(password) > 255 {
+			return errors.New("credentials too long")
+		}
+		req := []byte{0x01, byte(len(username))}
+		req = append(req, username...)
+		req = append(req, byte(len(password)))
+		req = append(req, password...)
+		if _, err := conn.Write(req); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return err
+		}
+		if buf[1] != 0x00 {
+			return errors.New("authentication rejected")
+		}
+	default:
+		return errors.New("no acceptable authentication method")
+	}
+
+	req := []byte{0x05, socksCmdConnect, 0x00}
+	if ip := net.ParseIP(host); ip != nil {
+		req = appendSocksAddr(req, &net.TCPAddr{IP: ip, Port: port})
+	} else {
+		if len(host) > 255 {
+			return errors.New("hostname too long")
+		}
+		req = append(req, socksAtypDomain, byte(len(host)))
+		req = append(req, host...)
+		req = binary.BigEndian.AppendUint16(req, uint16(port))
+	}
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 3)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if _, _, err := readSocksAddr(conn); err != nil {
+		return err
+	}
+	if reply[1] != socksRepSucceeded {
+		return fmt.Errorf("CONNECT %s failed with code %d", addr, reply[1])
+	}
+	return nil
+}
+
+// httpConnect opens a tunnel to addr with an HTTP CONNECT request over conn.
+// The returned conn must be used instead of conn, as the response reader may
+// already hold bytes from the tunnel.
+func httpConnect(conn net.Conn, username, password, addr string) (net.Conn, error) {
+	req := "CONNECT " + addr + " HTTP/1.1\r\nHost: " + addr + "\r\n"
+	if username != "" {
+		cred := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+		req += "Proxy-Authorization: Basic " + cred + "\r\n"
+	}
+	req += "\r\n"
+	if _, err := io.WriteString(conn, req); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("CONNECT %s failed: %s", addr, resp.Status)
+	}
+	return &bufferedConn{Conn: conn, r: br}, nil
+}
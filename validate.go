@@ -0,0 +1,416 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// fieldError reports an invalid config value. Field is the JSON path of the
+// value, such as "rules[2].value" or "outbounds.gfw.server", so the web UI
+// can show the message next to the input; it is empty for errors that
+// concern the request as a whole.
+type fieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// fieldErrors carries validation errors through functions that return an error.
+type fieldErrors []fieldError
+
+func (errs fieldErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, e := range errs {
+		msgs[i] = e.Field + ": " + e.Message
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// writeFieldErrors answers 400 with the list of field errors.
+func writeFieldErrors(w http.ResponseWriter, errs []fieldError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string][]fieldError{"errors": errs})
+}
+
+// normalizeConfig cleans up user-entered values before validation: domains
+// are reduced to the bare lowercase name, bare IPs in CIDR rules get a
+// host prefix, and surrounding whitespace is trimmed.
+func normalizeConfig(cfg *Config) {
+	normalizeRules(cfg.Rules)
+	normalizeOutbounds(cfg.Outbounds)
+	for name, prof := range cfg.Profiles {
+		prof.Rules = slices.Clone(prof.Rules)
+		prof.Outbounds = maps.Clone(prof.Outbounds)
+		normalizeRules(prof.Rules)
+		normalizeOutbounds(prof.Outbounds)
+		if prof.Match != nil {
+			m := *prof.Match
+			m.Gateway = strings.TrimSpace(m.Gateway)
+			m.Iface = strings.TrimSpace(m.Iface)
+			m.Subnet = strings.TrimSpace(m.Subnet)
+			m.Probe = strings.TrimSpace(m.Probe)
+			if m == (ProfileMatch{}) {
+				prof.Match = nil
+			} else {
+				prof.Match = &m
+			}
+		}
+		cfg.Profiles[name] = prof
+	}
+	for i := range cfg.Lists {
+		l := &cfg.Lists[i]
+		l.Name = strings.TrimSpace(l.Name)
+		l.URL = strings.TrimSpace(l.URL)
+		if l.Format == "" {
+			l.Format = ListFormatABP
+		}
+	}
+	cfg.DNSServer.Listen = strings.TrimSpace(cfg.DNSServer.Listen)
+}
+
+func normalizeRules(rules []Rule) {
+	for i := range rules {
+		r := &rules[i]
+		r.Type = strings.TrimSpace(r.Type)
+		r.Value = strings.TrimSpace(r.Value)
+		r.Outbound = strings.TrimSpace(r.Outbound)
+		r.Fallback = strings.TrimSpace(r.Fallback)
+		switch r.Type {
+		case RuleDomain, RuleDomainSuffix:
+			r.Value = normalizeDomain(r.Value)
+		case RuleDomainKeyword:
+			r.Value = strings.ToLower(r.Value)
+		case RuleCIDR:
+			if ip := net.ParseIP(r.Value); ip != nil {
+				if ip.To4() != nil {
+					r.Value += "/32"
+				} else {
+					r.Value += "/128"
+				}
+			}
+		}
+	}
+}
+
+func normalizeOutbounds(outbounds map[string]Outbound) {
+	for name, ob := range outbounds {
+		ob.Server = strings.TrimSpace(ob.Server)
+		ob.SourceIP = strings.TrimSpace(ob.SourceIP)
+		ob.SourceIPv6 = strings.TrimSpace(ob.SourceIPv6)
+		if ob.IfaceMatch != nil {
+			m := *ob.IfaceMatch
+			m.Name = strings.TrimSpace(m.Name)
+			m.CIDR = strings.TrimSpace(m.CIDR)
+			m.Flags = nil
+			for _, f := range ob.IfaceMatch.Flags {
+				if f = strings.ToLower(strings.TrimSpace(f)); f != "" {
+					m.Flags = append(m.Flags, f)
+				}
+			}
+			ob.IfaceMatch = &m
+		}
+		if ob.HealthCheck != nil {
+			c := *ob.HealthCheck
+			c.Type = strings.ToLower(strings.TrimSpace(c.Type))
+			c.Target = strings.TrimSpace(c.Target)
+			ob.HealthCheck = &c
+		}
+		outbounds[name] = ob
+	}
+}
+
+// normalizeDomain turns input such as "https://Foo.com:8443/path" or
+// ".foo.com." into the bare lowercase domain "foo.com".
+func normalizeDomain(s string) string {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if _, rest, ok := strings.Cut(s, "://"); ok {
+		s = rest
+	}
+	if i := strings.IndexAny(s, "/?#"); i >= 0 {
+		s = s[:i]
+	}
+	if i := strings.LastIndexByte(s, '@'); i >= 0 {
+		s = s[i+1:]
+	}
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	return strings.Trim(s, ".")
+}
+
+// validDomain reports whether s is a domain name of ASCII labels. Underscores
+// are accepted, as they appear in real service names.
+func validDomain(s string) bool {
+	if s == "" || len(s) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(s, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// validateConfig checks a normalized config and returns every problem found,
+// including interfaces of the active outbounds that do not exist.
+func validateConfig(cfg *Config) []fieldError {
+	return append(validateConfigStructure(cfg), missingInterfaces(cfg)...)
+}
+
+// missingInterfaces reports outbounds whose interface does not exist right
+// now. Matched interfaces may legitimately be absent, e.g. while a VPN is
+// down, and are not checked.
+func missingInterfaces(cfg *Config) []fieldError {
+	list, err := net.Interfaces()
+	if err != nil || len(list) == 0 {
+		return nil
+	}
+	ifaces := make(map[string]bool)
+	for _, iface := range list {
+		ifaces[iface.Name] = true
+	}
+	var errs []fieldError
+	for _, name := range slices.Sorted(maps.Keys(cfg.Outbounds)) {
+		ob := cfg.Outbounds[name]
+		if ob.IfaceMatch == nil && ob.Iface != "" && !ifaces[ob.Iface] {
+			errs = append(errs, fieldError{Field: "outbounds." + name + ".iface", Message: fmt.Sprintf("interface %s does not exist", ob.Iface)})
+		}
+	}
+	return errs
+}
+
+// validateConfigStructure is validateConfig without the check that
+// interfaces exist. Inactive profiles are only checked this way, since they
+// are usually meant for a network whose interfaces are not up right now.
+func validateConfigStructure(cfg *Config) []fieldError {
+	var errs []fieldError
+	add := func(field, format string, args ...interface{}) {
+		errs = append(errs, fieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if cfg.Port < 1 || cfg.Port > 65535 {
+		add("port", "must be between 1 and 65535")
+	}
+	if cfg.HTTPPort < 0 || cfg.HTTPPort > 65535 {
+		add("httpPort", "must be between 1 and 65535, or 0 to disable")
+	} else if cfg.HTTPPort != 0 && cfg.HTTPPort == cfg.Port {
+		add("httpPort", "must differ from the proxy port")
+	}
+
+	if _, ok := cfg.Outbounds[OutboundDefault]; !ok {
+		add("outbounds", "the %s outbound is required", OutboundDefault)
+	}
+	names := make([]string, 0, len(cfg.Outbounds))
+	for name := range cfg.Outbounds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		ob := cfg.Outbounds[name]
+		field := "outbounds." + name
+		if name == OutboundReject || !listNameRegex.MatchString(name) {
+			add(field+".name", "must be letters, digits, '-' or '_', and not %q", OutboundReject)
+		}
+		switch ob.Type {
+		case "", OutboundInterface:
+		case OutboundSOCKS5, OutboundHTTP:
+			if _, _, err := splitHostPortDefault(ob.Server, 0); err != nil {
+				add(field+".server", "must be host:port")
+			}
+		default:
+			add(field+".type", "unknown outbound type %q", ob.Type)
+		}
+		if ob.IfaceMatch != nil {
+			if ob.Iface != "" {
+				add(field+".iface", "set either an interface or an interface match, not both")
+			}
+			if err := ob.IfaceMatch.validate(); err != nil {
+				add(field+".ifaceMatch", "%v", err)
+			}
+		}
+		if ob.SourceIP != "" {
+			if ip := net.ParseIP(ob.SourceIP); ip == nil || ip.To4() == nil {
+				add(field+".sourceIp", "must be an IPv4 address")
+			}
+		}
+		if ob.SourceIPv6 != "" {
+			if ip := net.ParseIP(ob.SourceIPv6); ip == nil || ip.To4() != nil {
+				add(field+".sourceIpv6", "must be an IPv6 address")
+			}
+		}
+		if ob.FwMark < 0 {
+			add(field+".fwMark", "must not be negative")
+		}
+		for _, s := range ob.DNS {
+			if _, err := parseDNSUpstream(s); err != nil {
+				add(field+".dns", "%v", err)
+			}
+		}
+		if c := ob.HealthCheck; c != nil {
+			switch c.Type {
+			case HealthCheckTCP:
+				if _, _, err := splitHostPortDefault(c.Target, 0); err != nil {
+					add(field+".healthCheck.target", "must be host:port")
+				}
+			case HealthCheckHTTP:
+				if u, err := url.Parse(c.Target); err != nil || !isRemoteList(c.Target) || u.Host == "" {
+					add(field+".healthCheck.target", "%q is not an http(s) URL", c.Target)
+				}
+			default:
+				add(field+".healthCheck.type", "unknown health check type %q", c.Type)
+			}
+			if c.Interval != 0 && c.Interval < minHealthInterval {
+				add(field+".healthCheck.interval", "must be at least %d seconds, or 0 for the default", minHealthInterval)
+			}
+		}
+	}
+	outboundExists := func(name string) bool {
+		_, ok := cfg.Outbounds[name]
+		return ok || name == OutboundReject
+	}
+
+	listNames := make(map[string]bool)
+	for i, l := range cfg.Lists {
+		field := fmt.Sprintf("lists[%d]", i)
+		if !listNameRegex.MatchString(l.Name) {
+			add(field+".name", "must be letters, digits, '-' or '_'")
+		} else if listNames[l.Name] {
+			add(field+".name", "duplicate list name %q", l.Name)
+		}
+		listNames[l.Name] = true
+		switch l.Format {
+		case ListFormatABP, ListFormatDomains, ListFormatClash, ListFormatDnsmasq:
+		default:
+			add(field+".format", "unknown list format %q", l.Format)
+		}
+		if l.URL == "" {
+			add(field+".url", "a URL or local path is required")
+		}
+		if !outboundExists(l.Outbound) {
+			add(field+".outbound", "unknown outbound %q", l.Outbound)
+		}
+		if l.UpdateHours < 0 {
+			add(field+".updateHours", "must not be negative")
+		}
+		for _, m := range l.Mirrors {
+			if u, err := url.Parse(m); err != nil || !isRemoteList(m) || u.Host == "" {
+				add(field+".mirrors", "%q is not an http(s) URL", m)
+			}
+		}
+		for _, v := range l.Via {
+			if !outboundExists(v) || v == OutboundReject {
+				add(field+".via", "unknown outbound %q", v)
+			}
+		}
+	}
+
+	check := &ProxyServer{Config: Config{Lists: cfg.Lists}}
+	for i, r := range cfg.Rules {
+		field := fmt.Sprintf("rules[%d]", i)
+		switch {
+		case !knownRuleType(r.Type):
+			add(field+".type", "unknown rule type %q", r.Type)
+		case r.Value == "":
+			add(field+".value", "a value is required")
+		case (r.Type == RuleDomain || r.Type == RuleDomainSuffix) && !validDomain(r.Value):
+			add(field+".value", "%q is not a domain name", r.Value)
+		default:
+			if _, err := check.compileRule(r); err != nil {
+				add(field+".value", "%v", err)
+			}
+		}
+		if (r.Outbound == "" && r.Type != RuleList) || (r.Outbound != "" && !outboundExists(r.Outbound)) {
+			add(field+".outbound", "unknown outbound %q", r.Outbound)
+		}
+		if r.Fallback != "" {
+			if !outboundExists(r.Fallback) {
+				add(field+".fallback", "unknown outbound %q", r.Fallback)
+			} else if r.Fallback == r.Outbound {
+				add(field+".fallback", "must differ from the outbound")
+			}
+		}
+		for _, s := range r.DNS {
+			if _, err := parseDNSUpstream(s); err != nil {
+				add(field+".dns", "%v", err)
+			}
+		}
+	}
+
+	users := make(map[string]bool)
+	for _, u := range cfg.Auth.Users {
+		switch {
+		case u.Username == "" || len(u.Username) > 255 || len(u.Password) > 255:
+			add("auth.users", "user names and passwords must be 1 to 255 bytes")
+		case users[u.Username]:
+			add("auth.users", "duplicate user %q", u.Username)
+		}
+		users[u.Username] = true
+	}
+
+	if cfg.ActiveProfile != "" {
+		if _, ok := cfg.Profiles[cfg.ActiveProfile]; !ok {
+			add("activeProfile", "unknown profile %q", cfg.ActiveProfile)
+		}
+	}
+	profiles, _ := profileNames(cfg)
+	for _, name := range profiles {
+		field := "profiles." + name
+		if !listNameRegex.MatchString(name) {
+			add(field, "profile names must be letters, digits, '-' or '_'")
+		}
+		if m := cfg.Profiles[name].Match; m != nil {
+			if m.Gateway != "" {
+				if ip := net.ParseIP(m.Gateway); ip == nil || ip.To4() == nil {
+					add(field+".match.gateway", "must be an IPv4 address")
+				}
+			}
+			if m.Subnet != "" {
+				if ip, _, err := net.ParseCIDR(m.Subnet); err != nil || ip.To4() == nil {
+					add(field+".match.subnet", "must be an IPv4 CIDR such as 10.1.0.0/16")
+				}
+			}
+			if m.Probe != "" {
+				if _, _, err := splitHostPortDefault(m.Probe, 0); err != nil {
+					add(field+".match.probe", "must be host:port")
+				}
+			}
+		}
+		if name == cfg.ActiveProfile {
+			continue // validated above, as the top-level outbounds and rules
+		}
+		// Check the profile as it would run, with the shared lists and settings.
+		prof := cfg.Profiles[name]
+		c := *cfg
+		c.Outbounds, c.Rules, c.Profiles, c.ActiveProfile = prof.Outbounds, prof.Rules, nil, ""
+		for _, e := range validateConfigStructure(&c) {
+			if strings.HasPrefix(e.Field, "outbounds") || strings.HasPrefix(e.Field, "rules") || strings.HasPrefix(e.Field, "lists") {
+				errs = append(errs, fieldError{Field: field + "." + e.Field, Message: e.Message})
+			}
+		}
+	}
+
+	switch cfg.LinuxBind.Mode {
+	case "", "device", "mark":
+	default:
+		add("linuxBind.mode", "must be device or mark")
+	}
+	if cfg.DNSServer.Listen != "" {
+		if _, _, err := splitHostPortDefault(cfg.DNSServer.Listen, 0); err != nil {
+			add("dnsServer.listen", "must be host:port")
+		}
+	}
+	return errs
+}